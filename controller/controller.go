@@ -7,6 +7,8 @@ package main
 
 import (
 	"context"
+	"maps"
+	"slices"
 	"strconv"
 
 	"github.com/benc-uk/nanoproxy/pkg/config"
@@ -112,12 +114,16 @@ func buildConfig() {
 	conf := config.Config{}
 	upstreamMap := make(map[string]config.Upstream)
 
-	// Loop over all ingresses and build up config
-	for _, i := range ingressCache {
+	// Loop over all ingresses in key order and build up config, so the config file is the same each time
+	for _, key := range slices.Sorted(maps.Keys(ingressCache)) {
+		i := ingressCache[key]
+
 		// Check for annotations
 		scheme := "http"
 		stripPath := false
 
+		var upgrade *config.Upgrade
+
 		annotations := i.GetAnnotations()
 
 		if annotations != nil && annotations["nanoproxy/backend-protocol"] == "https" {
@@ -128,6 +134,10 @@ func buildConfig() {
 			stripPath = true
 		}
 
+		if annotations != nil && annotations["nanoproxy/websocket"] == "true" {
+			upgrade = &config.Upgrade{}
+		}
+
 		for _, rule := range i.Spec.Rules {
 			for _, path := range rule.HTTP.Paths {
 				svcName := path.Backend.Service.Name
@@ -153,20 +163,22 @@ func buildConfig() {
 					matchMode = "exact"
 				}
 
+				// Wildcard hosts like '*.example.com' are matched by the proxy the same way as Ingress
 				conf.Rules = append(conf.Rules, config.Rule{
 					Path:      pathString,
 					Upstream:  upstreamName,
 					MatchMode: matchMode,
 					StripPath: stripPath,
 					Host:      rule.Host,
+					Upgrade:   upgrade,
 				})
 			}
 		}
 	}
 
-	// Convert map of upstreams array in config
-	for _, u := range upstreamMap {
-		conf.Upstreams = append(conf.Upstreams, u)
+	// Convert map of upstreams array in config, sorted by name
+	for _, name := range slices.Sorted(maps.Keys(upstreamMap)) {
+		conf.Upstreams = append(conf.Upstreams, upstreamMap[name])
 	}
 
 	// We overwrite the config file each time, this is fine
@@ -1,35 +1,323 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"log/slog"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Names of the upstream balancer strategies
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceWeighted   = "weighted"
+	BalanceLeastConns = "least-connections"
+	BalanceRandomTwo  = "random-two-choices"
+)
+
+// Protocols used to talk to upstream targets
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+)
+
+// Failures which can be retried, used in RetryPolicy.RetryOn
+const (
+	RetryConnectFailure = "connect-failure"
+	RetryTimeout        = "timeout"
+	Retry502            = "502"
+	Retry503            = "503"
+	Retry504            = "504"
+)
+
+// Modes of listeners for raw TCP connections
+const (
+	ListenerTCP            = "tcp"
+	ListenerTLSPassthrough = "tls-passthrough"
+)
+
+// Names of the rule match modes, exact & regex also apply to hosts
+const (
+	MatchPrefix = "prefix"
+	MatchExact  = "exact"
+	MatchRegex  = "regex"
+	MatchGlob   = "glob"
+)
+
 // Config is the main configuration for the proxy
 type Config struct {
 	Upstreams []Upstream `yaml:"upstreams"`
 	Rules     []Rule     `yaml:"rules"`
+	Listeners []Listener `yaml:"listeners,omitempty"`
 	Filepath  string     `yaml:"-"`
 }
 
-// Upstream is a backend server
+// Upstream is a backend server, or a group of servers when targets are set
 type Upstream struct {
-	Name          string `yaml:"name"`
-	Host          string `yaml:"host"`
-	Port          int    `yaml:"port"`
-	Scheme        string `yaml:"scheme"`
-	NoHostRewrite bool   `yaml:"noHostRewrite"`
+	Name             string            `yaml:"name"`
+	Host             string            `yaml:"host"`
+	Port             int               `yaml:"port"`
+	Scheme           string            `yaml:"scheme"`
+	NoHostRewrite    bool              `yaml:"noHostRewrite"`
+	Targets          []Target          `yaml:"targets,omitempty"`
+	Balancer         string            `yaml:"balancer,omitempty"`
+	HealthCheck      *HealthCheck      `yaml:"healthCheck,omitempty"`
+	OutlierDetection *OutlierDetection `yaml:"outlierDetection,omitempty"`
+	Retries          *RetryPolicy      `yaml:"retries,omitempty"`
+	CircuitBreaker   *CircuitBreaker   `yaml:"circuitBreaker,omitempty"`
+	Timeouts         *Timeouts         `yaml:"timeouts,omitempty"`
+	ConnectionPool   *ConnectionPool   `yaml:"connectionPool,omitempty"`
+	Protocol         string            `yaml:"protocol,omitempty"`
+	MaxUpgradedConns int               `yaml:"maxUpgradedConns,omitempty"`
+}
+
+// Listener accepts TCP connections on a port of its own, which are forwarded to an upstream as a stream of bytes
+// In TLS passthrough mode the upstream is picked by the server name (SNI) the client sends, the TLS is not terminated
+type Listener struct {
+	Name        string        `yaml:"name,omitempty"`
+	Port        int           `yaml:"port"`
+	Mode        string        `yaml:"mode,omitempty"`
+	Upstream    string        `yaml:"upstream,omitempty"` // In TLS passthrough mode, used when no route matches
+	Routes      []SNIRoute    `yaml:"routes,omitempty"`
+	IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+}
+
+// SNIRoute sends TLS connections for a server name to an upstream, names starting with '*.' are wildcards
+type SNIRoute struct {
+	ServerName string `yaml:"serverName"`
+	Upstream   string `yaml:"upstream"`
+}
+
+// Target is a single instance of a backend server, traffic is balanced across targets
+type Target struct {
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port,omitempty"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+// HealthCheck configures active probing of the targets in an upstream
+type HealthCheck struct {
+	Path               string        `yaml:"path"`
+	ExpectedStatus     int           `yaml:"expectedStatus,omitempty"`
+	Interval           time.Duration `yaml:"interval,omitempty"`
+	Timeout            time.Duration `yaml:"timeout,omitempty"`
+	HealthyThreshold   int           `yaml:"healthyThreshold,omitempty"`
+	UnhealthyThreshold int           `yaml:"unhealthyThreshold,omitempty"`
+}
+
+// OutlierDetection configures passive health checking, targets failing real requests are ejected for a time
+type OutlierDetection struct {
+	ConsecutiveErrors  int           `yaml:"consecutiveErrors,omitempty"`
+	Consecutive5xx     int           `yaml:"consecutive5xx,omitempty"`
+	FailurePercent     int           `yaml:"failurePercent,omitempty"`
+	MinRequests        int           `yaml:"minRequests,omitempty"`
+	Interval           time.Duration `yaml:"interval,omitempty"`
+	BaseEjectionTime   time.Duration `yaml:"baseEjectionTime,omitempty"`
+	MaxEjectionTime    time.Duration `yaml:"maxEjectionTime,omitempty"`
+	MaxEjectionPercent int           `yaml:"maxEjectionPercent,omitempty"`
+}
+
+// RetryPolicy configures retrying requests which fail, retries go to a different target when there is one
+type RetryPolicy struct {
+	Attempts      int           `yaml:"attempts,omitempty"` // Total tries, including the first
+	RetryOn       []string      `yaml:"retryOn,omitempty"`
+	Methods       []string      `yaml:"methods,omitempty"`
+	PerTryTimeout time.Duration `yaml:"perTryTimeout,omitempty"`
+	BackOff       time.Duration `yaml:"backOff,omitempty"`
+	MaxBackOff    time.Duration `yaml:"maxBackOff,omitempty"`
+}
+
+// Timeouts for connecting to and waiting on the targets of an upstream
+type Timeouts struct {
+	Connect        time.Duration `yaml:"connect,omitempty"`
+	TLSHandshake   time.Duration `yaml:"tlsHandshake,omitempty"`
+	ResponseHeader time.Duration `yaml:"responseHeader,omitempty"`
+	Idle           time.Duration `yaml:"idle,omitempty"`
+}
+
+// ConnectionPool tunes the pool of connections kept to each target of an upstream
+type ConnectionPool struct {
+	MaxIdleConns      int           `yaml:"maxIdleConns,omitempty"`
+	MaxConns          int           `yaml:"maxConns,omitempty"`
+	KeepAlive         time.Duration `yaml:"keepAlive,omitempty"`
+	DisableKeepAlives bool          `yaml:"disableKeepAlives,omitempty"`
+}
+
+// CircuitBreaker stops requests going to a failing upstream, and limits the requests in flight to it
+type CircuitBreaker struct {
+	FailureThreshold int           `yaml:"failureThreshold,omitempty"`
+	OpenDuration     time.Duration `yaml:"openDuration,omitempty"`
+	HalfOpenRequests int           `yaml:"halfOpenRequests,omitempty"`
+	MaxRequests      int           `yaml:"maxRequests,omitempty"`
+	MaxPending       int           `yaml:"maxPending,omitempty"`
+	PendingTimeout   time.Duration `yaml:"pendingTimeout,omitempty"`
 }
 
 // Rule sets host and/or path to match and the upstream to use
 type Rule struct {
-	Path      string `yaml:"path"`
-	Upstream  string `yaml:"upstream"`
-	MatchMode string `yaml:"matchMode"`
-	Host      string `yaml:"host"`
-	StripPath bool   `yaml:"stripPath"`
+	Path          string        `yaml:"path"`
+	Upstream      string        `yaml:"upstream"`
+	MatchMode     string        `yaml:"matchMode"`
+	Host          string        `yaml:"host"`
+	HostMatchMode string        `yaml:"hostMatchMode,omitempty"`
+	StripPath     bool          `yaml:"stripPath"`
+	Rewrite       *Rewrite      `yaml:"rewrite,omitempty"`
+	Methods       []string      `yaml:"methods,omitempty"`
+	Headers       []Match       `yaml:"headers,omitempty"`
+	Query         []Match       `yaml:"query,omitempty"`
+	Cookies       []Match       `yaml:"cookies,omitempty"`
+	Priority      int           `yaml:"priority,omitempty"`
+	Name          string        `yaml:"name,omitempty"`
+	Timeout       time.Duration `yaml:"timeout,omitempty"`
+	GRPC          *GRPCMatch    `yaml:"grpc,omitempty"`
+	Upgrade       *Upgrade      `yaml:"upgrade,omitempty"`
+}
+
+// Upgrade opts a rule into long-lived upgraded connections, e.g. WebSockets, timed out by these not the rule timeout
+type Upgrade struct {
+	IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+	MaxDuration time.Duration `yaml:"maxDuration,omitempty"`
+}
+
+// GRPCMatch matches gRPC requests, to a service or a single method of a service
+// With neither set all gRPC requests are matched
+type GRPCMatch struct {
+	Service string `yaml:"service,omitempty"` // Fully qualified, e.g. 'helloworld.Greeter'
+	Method  string `yaml:"method,omitempty"`
+}
+
+// Match is a condition on a named header, query parameter or cookie in the request
+// With only a name set it must be present, otherwise the value must equal value or match regex
+type Match struct {
+	Name    string `yaml:"name"`
+	Value   string `yaml:"value,omitempty"`
+	Regex   string `yaml:"regex,omitempty"`
+	Present *bool  `yaml:"present,omitempty"`
+}
+
+// Rewrite changes the request path before it is sent to the upstream
+type Rewrite struct {
+	Path        string `yaml:"path,omitempty"`
+	Prefix      string `yaml:"prefix,omitempty"`
+	Regex       string `yaml:"regex,omitempty"`
+	Replacement string `yaml:"replacement,omitempty"`
+	BasePath    string `yaml:"basePath,omitempty"`
+}
+
+// WithGRPC returns the rule with the gRPC service & method turned into the path and the condition which match
+// them, gRPC requests are POSTs to '/{service}/{method}' with a content type of application/grpc
+func (r Rule) WithGRPC() Rule {
+	if r.GRPC == nil {
+		return r
+	}
+
+	r.Path = "/"
+	r.MatchMode = MatchPrefix
+
+	if r.GRPC.Service != "" {
+		r.Path += r.GRPC.Service + "/"
+	}
+
+	if r.GRPC.Method != "" {
+		r.Path += r.GRPC.Method
+		r.MatchMode = MatchExact
+	}
+
+	r.Headers = append(slices.Clone(r.Headers), Match{Name: "Content-Type", Regex: "^application/grpc"})
+
+	return r
+}
+
+// ComparePrecedence orders rules by which is checked first when routing, rules which sort first win.
+// In order of precedence:
+// - Higher priority
+// - Exact host, then wildcard host (longest first), then regex host, then rules without a host
+// - Exact path, then regex & glob paths, then prefix paths (longest first)
+// - More conditions on method, headers, query & cookies
+// Anything else is left in the order of the config file, so sort with a stable sort
+// gRPC rules should be passed through WithGRPC first
+func ComparePrecedence(a, b Rule) int {
+	if c := cmp.Compare(b.Priority, a.Priority); c != 0 {
+		return c
+	}
+
+	if c := cmp.Compare(a.hostRank(), b.hostRank()); c != 0 {
+		return c
+	}
+
+	if a.hostRank() == hostRankWildcard {
+		if c := cmp.Compare(len(b.Host), len(a.Host)); c != 0 {
+			return c
+		}
+	}
+
+	if c := cmp.Compare(a.pathRank(), b.pathRank()); c != 0 {
+		return c
+	}
+
+	if a.pathRank() == pathRankPrefix {
+		if c := cmp.Compare(len(b.Path), len(a.Path)); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(b.conditionCount(), a.conditionCount())
+}
+
+// Ranks of host & path matches, lower is more specific
+const (
+	hostRankExact = iota
+	hostRankWildcard
+	hostRankRegex
+	hostRankAny
+)
+
+const (
+	pathRankExact = iota
+	pathRankPattern
+	pathRankPrefix
+)
+
+func (r Rule) hostRank() int {
+	switch {
+	case r.HostMatchMode == MatchRegex:
+		return hostRankRegex
+	case strings.HasPrefix(r.Host, "*."):
+		return hostRankWildcard
+	case r.Host != "":
+		return hostRankExact
+	}
+
+	return hostRankAny
+}
+
+func (r Rule) pathRank() int {
+	switch r.MatchMode {
+	case MatchExact:
+		return pathRankExact
+	case MatchRegex, MatchGlob:
+		return pathRankPattern
+	}
+
+	return pathRankPrefix
+}
+
+// Number of conditions on the rule, a list of methods counts as one
+func (r Rule) conditionCount() int {
+	count := len(r.Headers) + len(r.Query) + len(r.Cookies)
+	if len(r.Methods) > 0 {
+		count++
+	}
+
+	return count
 }
 
 var configPath = "./config.yaml"
@@ -50,26 +338,46 @@ func GetPath() string {
 // Load reads the configuration file and returns the configuration.
 // It returns an error if the configuration file cannot be loaded.
 func Load() (*Config, error) {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		log.Printf("Config error: %v", err)
+	slog.Info("Loading config", "path", configPath)
 
+	conf, err := LoadFile(configPath)
+	if err != nil {
+		slog.Error("Config error", "error", err)
 		return nil, err
 	}
 
-	log.Println("Loading config from: " + configPath)
+	slog.Debug("Config dump", "config", *conf)
+
+	return conf, nil
+}
+
+// LoadFile reads and parses the configuration file at the given path, without logging.
+// The config is not validated, call Validate to check it.
+func LoadFile(path string) (*Config, error) {
+	return loadFile(path, false)
+}
 
-	// Load config file
-	conf := Config{}
+// LoadFileStrict is like LoadFile, but unknown keys are an error rather than ignored.
+// This catches typos such as `stripPaths` which would otherwise silently change routing.
+func LoadFileStrict(path string) (*Config, error) {
+	return loadFile(path, true)
+}
 
-	err = yaml.Unmarshal([]byte(data), &conf)
+func loadFile(path string, strict bool) (*Config, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("Config error: %v", err)
 		return nil, err
 	}
 
-	if os.Getenv("DEBUG") != "" {
-		log.Printf("Config dump:\n %+v\n", conf)
+	conf := Config{Filepath: path}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+
+	// An empty file has no documents, which is an empty config rather than an error
+	err = dec.Decode(&conf)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
 	}
 
 	return &conf, nil
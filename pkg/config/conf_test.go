@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 var yamlConfig = `
@@ -91,6 +92,30 @@ func TestConfigInvalid(t *testing.T) {
 	}
 }
 
+func TestConfigUnknownKey(t *testing.T) {
+	_ = os.WriteFile(GetPath(), []byte(yamlConfig+"    stripPaths: true\n"), 0600)
+
+	// Unknown keys are ignored when the proxy loads the config, so old keys don't stop it starting
+	if conf, err := LoadFile(GetPath()); err != nil || len(conf.Rules) != 2 {
+		t.Errorf("Expected unknown key to be ignored, got %v", err)
+	}
+
+	conf, err := LoadFileStrict(GetPath())
+	if err == nil || !strings.Contains(err.Error(), "stripPaths") {
+		t.Errorf("Expected error for unknown key, got %v", err)
+	}
+
+	if conf != nil {
+		t.Errorf("Expected nil config, got %+v", conf)
+	}
+
+	_ = os.WriteFile(GetPath(), []byte(""), 0600)
+
+	if _, err := LoadFileStrict(GetPath()); err != nil {
+		t.Errorf("Expected no error loading empty config, got %v", err)
+	}
+}
+
 func TestConfigValid(t *testing.T) {
 	_ = os.WriteFile(GetPath(), []byte(yamlConfig), 0600)
 
@@ -160,3 +185,32 @@ func TestConfigWrite(t *testing.T) {
 		t.Errorf("Expected config to match, got %s", string(bytes))
 	}
 }
+
+func TestConfigHealthCheck(t *testing.T) {
+	_ = os.WriteFile(GetPath(), []byte(`
+upstreams:
+  - name: backends
+    targets:
+      - host: a.example
+      - host: b.example
+        weight: 2
+    healthCheck:
+      path: /healthz
+      interval: 5s
+      timeout: 500ms
+`), 0600)
+
+	conf, err := Load()
+	if err != nil {
+		t.Fatalf("Expected no error loading config, got %v", err)
+	}
+
+	hc := conf.Upstreams[0].HealthCheck
+	if hc == nil || hc.Interval != 5*time.Second || hc.Timeout != 500*time.Millisecond {
+		t.Errorf("Expected health check durations to be parsed, got %+v", hc)
+	}
+
+	if len(conf.Upstreams[0].Targets) != 2 || conf.Upstreams[0].Targets[1].Weight != 2 {
+		t.Errorf("Expected two targets, got %+v", conf.Upstreams[0].Targets)
+	}
+}
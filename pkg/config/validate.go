@@ -0,0 +1,442 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ValidationError is a single problem found in the config
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors holds all the problems found in the config
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, v := range e {
+		msgs = append(msgs, v.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the config for problems, the returned error will be of type ValidationErrors
+// It returns nil when the config is valid
+func (c Config) Validate() error {
+	errs := ValidationErrors{}
+
+	add := func(field string, format string, args ...any) {
+		errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	names := make(map[string]bool)
+
+	for i, u := range c.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+
+		if u.Name == "" {
+			add(field+".name", "name is required")
+		} else if names[u.Name] {
+			add(field+".name", "duplicate upstream name '%s'", u.Name)
+		}
+
+		names[u.Name] = true
+
+		if u.Host == "" && len(u.Targets) == 0 {
+			add(field+".host", "host or targets is required")
+		}
+
+		if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+			add(field+".scheme", "invalid scheme '%s', must be 'http' or 'https'", u.Scheme)
+		}
+
+		if u.Port < 0 || u.Port > 65535 {
+			add(field+".port", "port %d out of range", u.Port)
+		}
+
+		if u.Balancer != "" && !slices.Contains(balancers, u.Balancer) {
+			add(field+".balancer", "unknown balancer '%s', must be one of %s", u.Balancer, strings.Join(balancers, ", "))
+		}
+
+		for j, t := range u.Targets {
+			targetField := fmt.Sprintf("%s.targets[%d]", field, j)
+
+			if t.Host == "" {
+				add(targetField+".host", "host is required")
+			}
+
+			if t.Port < 0 || t.Port > 65535 {
+				add(targetField+".port", "port %d out of range", t.Port)
+			}
+
+			if t.Weight < 0 {
+				add(targetField+".weight", "weight can't be negative")
+			}
+		}
+
+		if hc := u.HealthCheck; hc != nil {
+			if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+				add(field+".healthCheck.expectedStatus", "status %d is not a valid HTTP status", hc.ExpectedStatus)
+			}
+
+			if hc.Interval < 0 || hc.Timeout < 0 {
+				add(field+".healthCheck", "interval and timeout can't be negative")
+			}
+		}
+
+		if od := u.OutlierDetection; od != nil && (od.FailurePercent < 0 || od.FailurePercent > 100) {
+			add(field+".outlierDetection.failurePercent", "must be between 0 and 100")
+		}
+
+		if rp := u.Retries; rp != nil {
+			if rp.Attempts < 0 {
+				add(field+".retries.attempts", "attempts can't be negative")
+			}
+
+			for _, on := range rp.RetryOn {
+				if !slices.Contains(retryOns, on) {
+					add(field+".retries.retryOn", "unknown failure '%s', must be one of %s", on, strings.Join(retryOns, ", "))
+				}
+			}
+
+			if rp.PerTryTimeout < 0 || rp.BackOff < 0 || rp.MaxBackOff < 0 {
+				add(field+".retries", "timeout and back-off can't be negative")
+			}
+
+			if rp.MaxBackOff > 0 && rp.MaxBackOff < rp.BackOff {
+				add(field+".retries.maxBackOff", "can't be less than backOff")
+			}
+		}
+
+		switch u.Protocol {
+		case "", ProtocolHTTP1:
+		case ProtocolH2:
+			if u.Scheme != "https" {
+				add(field+".protocol", "protocol 'h2' requires scheme 'https', use 'h2c' for http")
+			}
+		case ProtocolH2C:
+			if u.Scheme == "https" {
+				add(field+".protocol", "protocol 'h2c' requires scheme 'http', use 'h2' for https")
+			}
+		default:
+			add(field+".protocol", "invalid protocol '%s', must be 'http1', 'h2' or 'h2c'", u.Protocol)
+		}
+
+		if cp := u.ConnectionPool; cp != nil && (cp.MaxIdleConns < 0 || cp.MaxConns < 0 || cp.KeepAlive < 0) {
+			add(field+".connectionPool", "pool sizes and keep-alive can't be negative")
+		}
+
+		if u.MaxUpgradedConns < 0 {
+			add(field+".maxUpgradedConns", "max upgraded connections can't be negative")
+		}
+
+		if to := u.Timeouts; to != nil && (to.Connect < 0 || to.TLSHandshake < 0 || to.ResponseHeader < 0 || to.Idle < 0) {
+			add(field+".timeouts", "timeouts can't be negative")
+		}
+
+		if cb := u.CircuitBreaker; cb != nil {
+			if cb.FailureThreshold < 0 || cb.HalfOpenRequests < 0 || cb.MaxRequests < 0 || cb.MaxPending < 0 {
+				add(field+".circuitBreaker", "thresholds and limits can't be negative")
+			}
+
+			if cb.OpenDuration < 0 || cb.PendingTimeout < 0 {
+				add(field+".circuitBreaker", "durations can't be negative")
+			}
+
+			if cb.MaxPending > 0 && cb.MaxRequests == 0 {
+				add(field+".circuitBreaker.maxPending", "requires maxRequests to be set")
+			}
+		}
+	}
+
+	for i, r := range c.Rules {
+		field := fmt.Sprintf("rules[%d]", i)
+
+		if g := r.GRPC; g != nil {
+			if r.Path != "" || r.MatchMode != "" || r.StripPath || r.Rewrite != nil {
+				add(field+".grpc", "can't be used with path, matchMode, stripPath or rewrite")
+			}
+
+			if g.Method != "" && g.Service == "" {
+				add(field+".grpc.method", "method requires a service")
+			}
+
+			if strings.Contains(g.Service, "/") || strings.Contains(g.Method, "/") {
+				add(field+".grpc", "service and method can't contain '/'")
+			}
+		}
+
+		// gRPC rules are checked as the path & conditions they match
+		r = r.WithGRPC()
+
+		if r.Upstream == "" {
+			add(field+".upstream", "upstream is required")
+		} else if !names[r.Upstream] {
+			add(field+".upstream", "upstream '%s' not found", r.Upstream)
+		}
+
+		if r.Timeout < 0 {
+			add(field+".timeout", "timeout can't be negative")
+		}
+
+		if up := r.Upgrade; up != nil && (up.IdleTimeout < 0 || up.MaxDuration < 0) {
+			add(field+".upgrade", "idle timeout and max duration can't be negative")
+		}
+
+		switch r.MatchMode {
+		case "", MatchPrefix, MatchExact, MatchGlob:
+		case MatchRegex:
+			checkRegex(add, field+".path", r.Path)
+		default:
+			add(field+".matchMode", "invalid match mode '%s'", r.MatchMode)
+		}
+
+		switch r.HostMatchMode {
+		case "":
+		case MatchRegex:
+			if r.Host == "" {
+				add(field+".host", "host is required with regex host match mode")
+			}
+
+			checkRegex(add, field+".host", r.Host)
+		default:
+			add(field+".hostMatchMode", "invalid host match mode '%s'", r.HostMatchMode)
+		}
+
+		if r.Rewrite != nil && r.Rewrite.Regex != "" {
+			checkRegex(add, field+".rewrite.regex", r.Rewrite.Regex)
+		}
+
+		groups := []struct {
+			name    string
+			matches []Match
+		}{{"headers", r.Headers}, {"query", r.Query}, {"cookies", r.Cookies}}
+
+		for _, group := range groups {
+			for j, m := range group.matches {
+				matchField := fmt.Sprintf("%s.%s[%d]", field, group.name, j)
+
+				if m.Name == "" {
+					add(matchField+".name", "name is required")
+				}
+
+				if m.Regex != "" {
+					checkRegex(add, matchField+".regex", m.Regex)
+				}
+
+				if m.Present != nil && !*m.Present && (m.Value != "" || m.Regex != "") {
+					add(matchField, "can't have a value or regex when present is false")
+				}
+			}
+		}
+	}
+
+	ports := make(map[int]bool)
+
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+
+		if l.Port < 1 || l.Port > 65535 {
+			add(field+".port", "port %d out of range", l.Port)
+		} else if ports[l.Port] {
+			add(field+".port", "duplicate listener port %d", l.Port)
+		}
+
+		ports[l.Port] = true
+
+		if l.Upstream != "" && !names[l.Upstream] {
+			add(field+".upstream", "upstream '%s' not found", l.Upstream)
+		}
+
+		if l.IdleTimeout < 0 {
+			add(field+".idleTimeout", "idle timeout can't be negative")
+		}
+
+		switch l.Mode {
+		case "", ListenerTCP:
+			if l.Upstream == "" {
+				add(field+".upstream", "upstream is required")
+			}
+
+			if len(l.Routes) > 0 {
+				add(field+".routes", "routes are only used in %s mode", ListenerTLSPassthrough)
+			}
+		case ListenerTLSPassthrough:
+			if l.Upstream == "" && len(l.Routes) == 0 {
+				add(field+".routes", "routes or upstream is required")
+			}
+		default:
+			add(field+".mode", "invalid mode '%s', must be '%s' or '%s'", l.Mode, ListenerTCP, ListenerTLSPassthrough)
+		}
+
+		serverNames := make(map[string]bool)
+
+		for j, r := range l.Routes {
+			routeField := fmt.Sprintf("%s.routes[%d]", field, j)
+			serverName := strings.ToLower(r.ServerName)
+
+			if serverName == "" {
+				add(routeField+".serverName", "server name is required")
+			} else if serverNames[serverName] {
+				add(routeField+".serverName", "duplicate server name '%s'", r.ServerName)
+			}
+
+			serverNames[serverName] = true
+
+			if r.Upstream == "" {
+				add(routeField+".upstream", "upstream is required")
+			} else if !names[r.Upstream] {
+				add(routeField+".upstream", "upstream '%s' not found", r.Upstream)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Warnings checks the config for problems which don't stop it being used, such as rules which can never match
+// because another rule is always picked before them. These are common when rules come from many sources, e.g.
+// two Ingresses for the same host & path during a migration, where the first rule simply wins
+func (c Config) Warnings() ValidationErrors {
+	warnings := ValidationErrors{}
+
+	for i, j := range findShadowed(c.Rules) {
+		if j >= 0 {
+			warnings = append(warnings, ValidationError{
+				Field:   fmt.Sprintf("rules[%d]", i),
+				Message: fmt.Sprintf("rule can never match, it is shadowed by rules[%d]", j),
+			})
+		}
+	}
+
+	return warnings
+}
+
+var balancers = []string{BalanceRoundRobin, BalanceWeighted, BalanceLeastConns, BalanceRandomTwo}
+
+var retryOns = []string{RetryConnectFailure, RetryTimeout, Retry502, Retry503, Retry504}
+
+func checkRegex(add func(string, string, ...any), field string, pattern string) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		add(field, "invalid regex: %v", err)
+	}
+}
+
+// Finds rules which can never match because another rule is always picked before them, for each rule
+// it returns the index of a rule shadowing it, or -1. A rule is shadowed by either a duplicate which is
+// checked first, or a prefix rule with no conditions which is checked first and matches every path it does.
+// Rules are grouped by what they match, so this doesn't compare every pair of rules
+func findShadowed(rules []Rule) []int {
+	shadowedBy := make([]int, len(rules))
+	normalised := make([]Rule, len(rules))
+	keys := make([]string, len(rules))
+
+	// Picked before b when routing, ties are left in the order of the config file
+	before := func(a, b int) bool {
+		c := ComparePrecedence(normalised[a], normalised[b])
+		return c < 0 || (c == 0 && a < b)
+	}
+
+	// The rule checked first for each match key, and each bare prefix rule keyed by host & path
+	first := make(map[string]int)
+	bare := make(map[string]int)
+
+	for i, rule := range rules {
+		r := rule.WithGRPC()
+		normalised[i] = r
+		keys[i] = matchKey(r)
+		shadowedBy[i] = -1
+
+		if j, ok := first[keys[i]]; !ok || before(i, j) {
+			first[keys[i]] = i
+		}
+
+		if r.conditionCount() == 0 && r.HostMatchMode == "" && r.pathRank() == pathRankPrefix {
+			key := bareKey(r.Host, r.Path)
+			if j, ok := bare[key]; !ok || before(i, j) {
+				bare[key] = i
+			}
+		}
+	}
+
+	for i, r := range normalised {
+		if j := first[keys[i]]; j != i {
+			shadowedBy[i] = j
+			continue
+		}
+
+		// Bare prefix rules of '/' match every path, otherwise only literal paths can be checked
+		paths := []string{"", "/"}
+		if r.pathRank() != pathRankPattern {
+			paths = paths[:0]
+			for n := 0; n <= len(r.Path); n++ {
+				paths = append(paths, r.Path[:n])
+			}
+		}
+
+		hosts := []string{""}
+		if r.HostMatchMode == "" && r.Host != "" {
+			hosts = append(hosts, r.Host)
+		}
+
+		for _, host := range hosts {
+			for _, path := range paths {
+				if j, ok := bare[bareKey(host, path)]; ok && j != i && before(j, i) {
+					shadowedBy[i] = j
+					break
+				}
+			}
+
+			if shadowedBy[i] >= 0 {
+				break
+			}
+		}
+	}
+
+	return shadowedBy
+}
+
+func bareKey(host string, path string) string {
+	return strings.ToLower(host) + " " + path
+}
+
+// Everything about a rule that affects which requests it matches, as a string for comparison
+func matchKey(r Rule) string {
+	mode := r.MatchMode
+	if mode == "" {
+		mode = MatchPrefix
+	}
+
+	methods := []string{}
+	for _, m := range r.Methods {
+		methods = append(methods, strings.ToUpper(m))
+	}
+
+	slices.Sort(methods)
+
+	key := fmt.Sprintf("%s|%s|%s|%s|%v", strings.ToLower(r.Host), r.HostMatchMode, mode, r.Path, methods)
+
+	for _, group := range [][]Match{r.Headers, r.Query, r.Cookies} {
+		key += "|"
+
+		for _, m := range group {
+			present := m.Present == nil || *m.Present
+			key += fmt.Sprintf("%s=%s~%s?%v,", m.Name, m.Value, m.Regex, present)
+		}
+	}
+
+	return key
+}
@@ -0,0 +1,284 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateGood(t *testing.T) {
+	conf := Config{
+		Upstreams: []Upstream{
+			{Name: "a", Host: "a.example.net"},
+			{Name: "b", Targets: []Target{{Host: "b1"}, {Host: "b2", Port: 8080, Weight: 2}}, Balancer: BalanceWeighted},
+		},
+		Rules: []Rule{
+			{Upstream: "a", Path: "/api", Methods: []string{"POST"}},
+			{Upstream: "a", Path: "/api"},
+			{Upstream: "b", Path: `^/users/\d+$`, MatchMode: MatchRegex},
+			{Upstream: "b", Path: "/", Host: "*.example.net"},
+			{Upstream: "b", Path: "/"},
+			{Upstream: "b", Path: "/", Host: "api.example.net"},
+			{Upstream: "a", Path: "/admin", MatchMode: MatchExact},
+			{Upstream: "b", GRPC: &GRPCMatch{Service: "helloworld.Greeter"}},
+			{Upstream: "a", GRPC: &GRPCMatch{Service: "helloworld.Greeter", Method: "SayHello"}},
+			{Upstream: "a", GRPC: &GRPCMatch{}},
+		},
+		Listeners: []Listener{
+			{Port: 5432, Upstream: "a"},
+			{Port: 8443, Mode: ListenerTLSPassthrough, Routes: []SNIRoute{{ServerName: "*.example.net", Upstream: "b"}}},
+		},
+	}
+
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+
+	if warnings := conf.Warnings(); len(warnings) > 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+}
+
+func TestValidateBad(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  Config
+		field string
+	}{
+		{
+			"duplicate upstream",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x"}, {Name: "a", Host: "y"}}},
+			"upstreams[1].name",
+		},
+		{
+			"no host",
+			Config{Upstreams: []Upstream{{Name: "a"}}},
+			"upstreams[0].host",
+		},
+		{
+			"bad scheme",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Scheme: "ftp"}}},
+			"upstreams[0].scheme",
+		},
+		{
+			"port range",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Port: 70000}}},
+			"upstreams[0].port",
+		},
+		{
+			"bad balancer",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Balancer: "cheese"}}},
+			"upstreams[0].balancer",
+		},
+		{
+			"bad retry on",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Retries: &RetryPolicy{RetryOn: []string{"500"}}}}},
+			"upstreams[0].retries.retryOn",
+		},
+		{
+			"retry back-off",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Retries: &RetryPolicy{BackOff: 2, MaxBackOff: 1}}}},
+			"upstreams[0].retries.maxBackOff",
+		},
+		{
+			"pending without max",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", CircuitBreaker: &CircuitBreaker{MaxPending: 5}}}},
+			"upstreams[0].circuitBreaker.maxPending",
+		},
+		{
+			"negative timeout",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Timeouts: &Timeouts{Idle: -1}}}},
+			"upstreams[0].timeouts",
+		},
+		{
+			"h2 without tls",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", Protocol: ProtocolH2}}},
+			"upstreams[0].protocol",
+		},
+		{
+			"grpc method without service",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", GRPC: &GRPCMatch{Method: "Get"}}},
+			},
+			"rules[0].grpc.method",
+		},
+		{
+			"negative upgrade limit",
+			Config{Upstreams: []Upstream{{Name: "a", Host: "x", MaxUpgradedConns: -1}}},
+			"upstreams[0].maxUpgradedConns",
+		},
+		{
+			"negative upgrade idle timeout",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", Path: "/ws", Upgrade: &Upgrade{IdleTimeout: -1}}},
+			},
+			"rules[0].upgrade",
+		},
+		{
+			"listener without upstream",
+			Config{Listeners: []Listener{{Port: 5432}}},
+			"listeners[0].upstream",
+		},
+		{
+			"duplicate listener port",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Listeners: []Listener{{Port: 5432, Upstream: "a"}, {Port: 5432, Upstream: "a"}},
+			},
+			"listeners[1].port",
+		},
+		{
+			"tcp listener with routes",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Listeners: []Listener{{Port: 5432, Upstream: "a", Routes: []SNIRoute{{ServerName: "db", Upstream: "a"}}}},
+			},
+			"listeners[0].routes",
+		},
+		{
+			"sni route dangling upstream",
+			Config{
+				Listeners: []Listener{
+					{Port: 443, Mode: ListenerTLSPassthrough, Routes: []SNIRoute{{ServerName: "a", Upstream: "b"}}},
+				},
+			},
+			"listeners[0].routes[0].upstream",
+		},
+		{
+			"dangling upstream",
+			Config{Rules: []Rule{{Upstream: "nope", Path: "/"}}},
+			"rules[0].upstream",
+		},
+		{
+			"bad match mode",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", Path: "/", MatchMode: "fuzzy"}},
+			},
+			"rules[0].matchMode",
+		},
+		{
+			"bad regex",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", Path: "(", MatchMode: MatchRegex}},
+			},
+			"rules[0].path",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.conf.Validate()
+
+		var errs ValidationErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: expected ValidationErrors, got %v", test.name, err)
+			continue
+		}
+
+		found := false
+
+		for _, e := range errs {
+			if e.Field == test.field {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("%s: expected error for field %s, got %v", test.name, test.field, err)
+		}
+	}
+}
+
+func TestValidateWarnings(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  Config
+		field string
+	}{
+		{
+			"duplicate rule",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", Path: "/"}, {Upstream: "a", Path: "/"}},
+			},
+			"rules[1]",
+		},
+		{
+			"shadowed by priority",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules: []Rule{
+					{Upstream: "a", Path: "/api", Priority: 10},
+					{Upstream: "a", Path: "/api/v1", MatchMode: MatchExact},
+				},
+			},
+			"rules[1]",
+		},
+		{
+			"shadowed by later rule",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", Path: "/api/x"}, {Upstream: "a", Path: "/", Priority: 10}},
+			},
+			"rules[0]",
+		},
+		{
+			"duplicate exact rule with lower priority",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules: []Rule{
+					{Upstream: "a", Path: "/api", MatchMode: MatchExact},
+					{Upstream: "a", Path: "/api", MatchMode: MatchExact, Priority: 5},
+				},
+			},
+			"rules[0]",
+		},
+		{
+			"glob shadowed by catch-all",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", Path: "/", Priority: 1}, {Upstream: "a", Path: "/*.css", MatchMode: MatchGlob}},
+			},
+			"rules[1]",
+		},
+		{
+			"grpc duplicate",
+			Config{
+				Upstreams: []Upstream{{Name: "a", Host: "x"}},
+				Rules:     []Rule{{Upstream: "a", GRPC: &GRPCMatch{Service: "s"}}, {Upstream: "a", GRPC: &GRPCMatch{Service: "s"}}},
+			},
+			"rules[1]",
+		},
+	}
+
+	for _, test := range tests {
+		// Shadowed rules don't stop the config being used
+		if err := test.conf.Validate(); err != nil {
+			t.Errorf("%s: expected valid config, got %v", test.name, err)
+		}
+
+		found := false
+
+		for _, w := range test.conf.Warnings() {
+			if w.Field == test.field {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("%s: expected warning for field %s, got %v", test.name, test.field, test.conf.Warnings())
+		}
+	}
+}
+
+func TestValidateErrorString(t *testing.T) {
+	conf := Config{Upstreams: []Upstream{{Name: "a"}, {Name: "a", Host: "x", Port: -1}}}
+
+	err := conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), "upstreams[1].port: port -1 out of range") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy access log, one line for every request handled
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Names of the access log formats
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+)
+
+const (
+	accessLogDefaultMaxSize  = 100 // In megabytes
+	accessLogDefaultMaxFiles = 5
+)
+
+// Writes access log lines in one of the formats, writes are serialised so lines don't interleave
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+// A single line in the access log, the fields are also used for the JSON format
+type accessEntry struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"requestId,omitempty"`
+	ClientIP        string    `json:"clientIp"`
+	Method          string    `json:"method"`
+	Host            string    `json:"host"`
+	URI             string    `json:"uri"`
+	Proto           string    `json:"proto"`
+	Status          int       `json:"status"`
+	Bytes           int64     `json:"bytes"`
+	Duration        float64   `json:"duration"` // Seconds
+	Rule            string    `json:"rule,omitempty"`
+	Upstream        string    `json:"upstream,omitempty"`
+	Target          string    `json:"target,omitempty"`
+	UpstreamLatency float64   `json:"upstreamLatency,omitempty"` // Seconds
+	Attempts        int       `json:"attempts,omitempty"`        // More than one when retried
+	UserAgent       string    `json:"userAgent,omitempty"`
+	Referer         string    `json:"referer,omitempty"`
+}
+
+// Builds an access logger from the ACCESS_LOG settings, returns nil when the access log is disabled
+// The output is 'stdout' or a file path, files are rotated when they reach the max size in megabytes
+func newAccessLoggerFromEnv() (*accessLogger, error) {
+	output := os.Getenv("ACCESS_LOG")
+	if output == "" {
+		return nil, nil
+	}
+
+	format := os.Getenv("ACCESS_LOG_FORMAT")
+	if format == "" {
+		format = accessLogJSON
+	}
+
+	if format != accessLogJSON && format != accessLogCommon && format != accessLogCombined {
+		return nil, fmt.Errorf("invalid access log format: %s", format)
+	}
+
+	if output == "stdout" {
+		return &accessLogger{out: os.Stdout, format: format}, nil
+	}
+
+	maxSize, err := envInt("ACCESS_LOG_MAX_SIZE", accessLogDefaultMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	maxFiles, err := envInt("ACCESS_LOG_MAX_FILES", accessLogDefaultMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := newRotatingFile(output, int64(maxSize)*1024*1024, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogger{out: file, format: format}, nil
+}
+
+// Reads an integer from an env var, returning the default when it's not set
+func envInt(name string, def int) (int, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("invalid value for %s: %s", name, val)
+	}
+
+	return i, nil
+}
+
+// Builds the access log entry for a finished request
+func newAccessEntry(r *http.Request, uri string, rec *responseRecorder, d decision, info *proxyInfo,
+	start time.Time) accessEntry {
+	entry := accessEntry{
+		Time:      start,
+		ClientIP:  r.RemoteAddr,
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       uri,
+		Proto:     r.Proto,
+		Status:    rec.statusCode(),
+		Bytes:     rec.bytes,
+		Duration:  time.Since(start).Seconds(),
+		Rule:      d.ruleName(),
+		Upstream:  d.upstreamName(),
+		UserAgent: r.UserAgent(),
+		Referer:   r.Referer(),
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.ClientIP = host
+	}
+
+	if id := requestIDFromContext(r.Context()); id != nil {
+		entry.RequestID = id.value
+	}
+
+	if info != nil {
+		entry.Target = info.target.url.Host
+		entry.UpstreamLatency = info.latency.Seconds()
+		entry.Attempts = info.attempt
+	}
+
+	return entry
+}
+
+// Writes an entry to the access log in the configured format
+func (al *accessLogger) write(entry accessEntry) {
+	var line []byte
+
+	switch al.format {
+	case accessLogJSON:
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	case accessLogCommon:
+		line = entry.appendCommon(nil)
+		line = append(line, '\n')
+	case accessLogCombined:
+		line = entry.appendCommon(nil)
+		line = fmt.Appendf(line, " %q %q\n", entry.Referer, entry.UserAgent)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	_, _ = al.out.Write(line)
+}
+
+// Appends the entry in Common Log Format e.g.
+// 127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
+func (e accessEntry) appendCommon(b []byte) []byte {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	return fmt.Appendf(b, "%s - - [%s] \"%s %s %s\" %d %s",
+		e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URI, e.Proto, e.Status, size)
+}
+
+// A log file which is rotated when it gets too big, old files are renamed with a numbered suffix
+// e.g. access.log -> access.log.1 -> access.log.2, and the oldest is removed
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(filepath.Clean(rf.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// Shuffles the old files along by one and starts a new file
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxFiles))
+
+	for i := rf.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+func TestAccessLogJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	backend := newBackend(t, "a")
+
+	np := &NanoProxy{accessLog: &accessLogger{out: buf, format: accessLogJSON}}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{{Name: "logged", Targets: []config.Target{backend}}},
+		Rules:     []config.Rule{{Name: "log-rule", Path: "/api", Upstream: "logged", StripPath: true}},
+	})
+
+	request, _ := http.NewRequest(http.MethodGet, "/api/things?x=1", nil)
+	request.RemoteAddr = "10.1.2.3:5555"
+	request.Header.Set("X-Request-ID", "abc123")
+	np.mainHandler(httptest.NewRecorder(), request)
+
+	entry := accessEntry{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid JSON log line %s: %v", buf.String(), err)
+	}
+
+	if entry.Rule != "log-rule" || entry.Upstream != "logged" || entry.Status != 200 || entry.Bytes != 1 {
+		t.Errorf("Unexpected log entry %+v", entry)
+	}
+
+	if entry.ClientIP != "10.1.2.3" || entry.RequestID != "abc123" || entry.URI != "/api/things?x=1" {
+		t.Errorf("Unexpected request fields in log entry %+v", entry)
+	}
+
+	if entry.Target == "" || entry.UpstreamLatency <= 0 || entry.Duration < entry.UpstreamLatency {
+		t.Errorf("Expected target & upstream latency in log entry %+v", entry)
+	}
+
+	// Requests that don't match a rule are logged too
+	buf.Reset()
+
+	request, _ = http.NewRequest(http.MethodGet, "/nope", nil)
+	np.mainHandler(httptest.NewRecorder(), request)
+
+	if !strings.Contains(buf.String(), `"status":404`) {
+		t.Errorf("Expected 404 to be logged, got %s", buf.String())
+	}
+}
+
+func TestAccessLogCommonFormats(t *testing.T) {
+	entry := accessEntry{
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC),
+		ClientIP:  "127.0.0.1",
+		Method:    http.MethodGet,
+		URI:       "/apache_pb.gif",
+		Proto:     "HTTP/1.0",
+		Status:    200,
+		Bytes:     2326,
+		UserAgent: "Mozilla/4.08",
+		Referer:   "http://www.example.com/start.html",
+	}
+
+	buf := &bytes.Buffer{}
+
+	(&accessLogger{out: buf, format: accessLogCommon}).write(entry)
+
+	expected := `127.0.0.1 - - [10/Oct/2000:13:55:36 +0000] "GET /apache_pb.gif HTTP/1.0" 200 2326` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected common log line %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+
+	(&accessLogger{out: buf, format: accessLogCombined}).write(entry)
+
+	combined := regexp.MustCompile(`^127\.0\.0\.1 .* 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"\n$`)
+	if !combined.MatchString(buf.String()) {
+		t.Errorf("Unexpected combined log line %q", buf.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	rf, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"}
+	for suffix, content := range expected {
+		data, _ := os.ReadFile(path + suffix)
+		if string(data) != content {
+			t.Errorf("Expected %s%s to contain %q, got %q", path, suffix, content, string(data))
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 old files to be kept")
+	}
+}
@@ -0,0 +1,182 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy load balancing strategies for upstream targets
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Names of the balancing strategies, as used in the config file
+const (
+	balanceRoundRobin = config.BalanceRoundRobin
+	balanceWeighted   = config.BalanceWeighted
+	balanceLeastConns = config.BalanceLeastConns
+	balanceRandomTwo  = config.BalanceRandomTwo
+)
+
+// A balancer picks one target from a set of targets for each request
+// Peek returns the target pick would return, but leaves the balancer as it was
+type balancer interface {
+	pick(targets []*target) *target
+	peek(targets []*target) *target
+}
+
+// Returns a balancer for the named strategy, blank defaults to round-robin
+func newBalancer(strategy string) (balancer, error) {
+	switch strategy {
+	case "", balanceRoundRobin:
+		return &roundRobin{}, nil
+	case balanceWeighted:
+		return &weightedRoundRobin{current: make(map[*target]int)}, nil
+	case balanceLeastConns:
+		return &leastConns{}, nil
+	case balanceRandomTwo:
+		return &randomTwo{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown balancer strategy: %s", strategy)
+}
+
+// Simple rotation through the targets in turn
+type roundRobin struct {
+	counter atomic.Uint64
+}
+
+func (b *roundRobin) pick(targets []*target) *target {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	n := b.counter.Add(1) - 1
+
+	return targets[n%uint64(len(targets))]
+}
+
+func (b *roundRobin) peek(targets []*target) *target {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	return targets[b.counter.Load()%uint64(len(targets))]
+}
+
+// Smooth weighted round-robin, the same algorithm as used by nginx
+// Targets are picked in proportion to their weight but interleaved evenly
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*target]int
+}
+
+func (b *weightedRoundRobin) pick(targets []*target) *target {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+
+	var best *target
+
+	for _, t := range targets {
+		b.current[t] += t.weight
+		total += t.weight
+
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+
+	b.current[best] -= total
+
+	return best
+}
+
+func (b *weightedRoundRobin) peek(targets []*target) *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *target
+
+	for _, t := range targets {
+		if best == nil || b.current[t]+t.weight > b.current[best]+best.weight {
+			best = t
+		}
+	}
+
+	return best
+}
+
+// Picks the target with the fewest requests in flight
+// The scan starts at a rotating offset so ties are spread out
+type leastConns struct {
+	counter atomic.Uint64
+}
+
+func (b *leastConns) pick(targets []*target) *target {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	return leastActive(targets, b.counter.Add(1)-1)
+}
+
+func (b *leastConns) peek(targets []*target) *target {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	return leastActive(targets, b.counter.Load())
+}
+
+// Scans the targets from the offset for the one with the fewest requests in flight
+func leastActive(targets []*target, offset uint64) *target {
+	var best *target
+
+	for i := range targets {
+		t := targets[(offset+uint64(i))%uint64(len(targets))]
+		if best == nil || t.active.Load() < best.active.Load() {
+			best = t
+		}
+	}
+
+	return best
+}
+
+// Power of two random choices, picks two targets at random and uses the least busy
+type randomTwo struct{}
+
+func (b *randomTwo) pick(targets []*target) *target {
+	switch len(targets) {
+	case 0:
+		return nil
+	case 1:
+		return targets[0]
+	}
+
+	//nolint:gosec
+	i, j := rand.IntN(len(targets)), rand.IntN(len(targets)-1)
+	if j >= i {
+		j++
+	}
+
+	if targets[j].active.Load() < targets[i].active.Load() {
+		return targets[j]
+	}
+
+	return targets[i]
+}
+
+// Choices are random so there is no state to leave alone
+func (b *randomTwo) peek(targets []*target) *target {
+	return b.pick(targets)
+}
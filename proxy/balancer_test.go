@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+)
+
+func makeTargets(weights ...int) []*target {
+	targets := []*target{}
+	for _, w := range weights {
+		targets = append(targets, &target{weight: w})
+	}
+
+	return targets
+}
+
+func countPicks(b balancer, targets []*target, n int) map[*target]int {
+	counts := make(map[*target]int)
+	for i := 0; i < n; i++ {
+		counts[b.pick(targets)]++
+	}
+
+	return counts
+}
+
+func TestBalancerUnknown(t *testing.T) {
+	_, err := newBalancer("cheese")
+	if err == nil {
+		t.Errorf("Expected error for unknown strategy, got none")
+	}
+}
+
+func TestBalancerNoTargets(t *testing.T) {
+	for _, s := range []string{balanceRoundRobin, balanceWeighted, balanceLeastConns, balanceRandomTwo} {
+		b, _ := newBalancer(s)
+		if b.pick(nil) != nil {
+			t.Errorf("Expected nil target from %s with no targets", s)
+		}
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, _ := newBalancer("")
+	targets := makeTargets(1, 1, 1)
+
+	counts := countPicks(b, targets, 300)
+	for i, tgt := range targets {
+		if counts[tgt] != 100 {
+			t.Errorf("Expected target %d picked 100 times, got %d", i, counts[tgt])
+		}
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	b, _ := newBalancer(balanceWeighted)
+	targets := makeTargets(3, 1)
+
+	counts := countPicks(b, targets, 400)
+	if counts[targets[0]] != 300 || counts[targets[1]] != 100 {
+		t.Errorf("Expected 300/100 split, got %d/%d", counts[targets[0]], counts[targets[1]])
+	}
+}
+
+func TestBalancerLeastConns(t *testing.T) {
+	b, _ := newBalancer(balanceLeastConns)
+	targets := makeTargets(1, 1, 1)
+	targets[0].active.Store(5)
+	targets[2].active.Store(2)
+
+	for i := 0; i < 10; i++ {
+		if b.pick(targets) != targets[1] {
+			t.Errorf("Expected least busy target to be picked")
+		}
+	}
+}
+
+func TestBalancerRandomTwo(t *testing.T) {
+	b, _ := newBalancer(balanceRandomTwo)
+	targets := makeTargets(1, 1)
+	targets[0].active.Store(10)
+
+	// With two targets both are always compared, so the idle one always wins
+	for i := 0; i < 10; i++ {
+		if b.pick(targets) != targets[1] {
+			t.Errorf("Expected least busy target to be picked")
+		}
+	}
+}
+
+func TestBalancerPeek(t *testing.T) {
+	for _, s := range []string{balanceRoundRobin, balanceWeighted, balanceLeastConns} {
+		b, _ := newBalancer(s)
+		targets := makeTargets(1, 3, 2)
+
+		for i := 0; i < 10; i++ {
+			next := b.peek(targets)
+			if again := b.peek(targets); again != next {
+				t.Fatalf("Expected %s peek to leave the balancer alone", s)
+			}
+
+			if picked := b.pick(targets); picked != next {
+				t.Fatalf("Expected %s pick %d to return the peeked target", s, i)
+			}
+		}
+	}
+}
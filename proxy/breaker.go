@@ -0,0 +1,373 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy circuit breakers, failing fast when an upstream is failing or busy
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Defaults for any circuit breaker settings not set in the config
+const (
+	breakerDefaultThreshold      = 5
+	breakerDefaultOpenDuration   = 30 * time.Second
+	breakerDefaultHalfOpen       = 1
+	breakerDefaultPendingTimeout = time.Second
+)
+
+// States of a circuit breaker
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var breakerStates = []string{breakerClosed, breakerOpen, breakerHalfOpen}
+
+var (
+	errBreakerOpen = errors.New("circuit breaker is open for upstream")
+	errBreakerFull = errors.New("too many requests for upstream")
+)
+
+// A circuit breaker in front of an upstream, it opens after too many failures in a row and then rejects
+// requests until the open duration is over. Then a few probe requests are let through (half-open), which
+// close the breaker if they all succeed or open it again if any fail
+type breaker struct {
+	conf     config.CircuitBreaker
+	upstream string
+	slots    chan struct{} // Limits requests in flight, nil when there's no limit
+
+	mu        sync.Mutex
+	state     string
+	failures  int       // Failures in a row while closed
+	openUntil time.Time // When an open breaker goes half-open
+	probes    int       // Probe requests in flight while half-open
+	successes int       // Successful probes while half-open
+	active    int       // Requests admitted & in flight
+	pending   int       // Requests waiting for a slot
+	retired   bool      // No longer used by the live config, so it leaves the metrics alone
+}
+
+// Breakers are shared by all snapshots of a proxy and looked up by upstream & settings, so a config reload
+// doesn't close an open breaker or let in more than the limit of requests
+type breakerCache struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// Status of a circuit breaker, as reported by the admin endpoint
+type breakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Active   int    `json:"active"`
+	Pending  int    `json:"pending"`
+}
+
+// Returns a copy of the circuit breaker config with defaults filled in
+func breakerDefaults(cb config.CircuitBreaker) config.CircuitBreaker {
+	if cb.FailureThreshold <= 0 {
+		cb.FailureThreshold = breakerDefaultThreshold
+	}
+
+	if cb.OpenDuration <= 0 {
+		cb.OpenDuration = breakerDefaultOpenDuration
+	}
+
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = breakerDefaultHalfOpen
+	}
+
+	if cb.PendingTimeout <= 0 {
+		cb.PendingTimeout = breakerDefaultPendingTimeout
+	}
+
+	return cb
+}
+
+// Returns the circuit breaker for the upstream, creating it if there isn't one with the same settings
+// Returns nil when the upstream has none configured
+func (c *breakerCache) get(upstream string, conf *config.CircuitBreaker) *breaker {
+	if conf == nil {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s %+v", upstream, *conf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.breakers == nil {
+		c.breakers = make(map[string]*breaker)
+	}
+
+	if b, ok := c.breakers[key]; ok {
+		return b
+	}
+
+	b := newBreaker(upstream, conf)
+	c.breakers[key] = b
+
+	return b
+}
+
+// Drops the breakers not used by the snapshot, the metrics then show the state of the breakers in use
+// Requests still in flight on an old snapshot carry on using the breaker they have
+func (c *breakerCache) retain(s *snapshot) {
+	used := make(map[*breaker]bool)
+
+	for _, up := range s.upstreams {
+		if up.breaker != nil {
+			used[up.breaker] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, b := range c.breakers {
+		if !used[b] {
+			b.retire()
+			delete(c.breakers, key)
+		}
+	}
+
+	for b := range used {
+		b.mu.Lock()
+		b.publish()
+		b.mu.Unlock()
+	}
+}
+
+// Builds a closed circuit breaker for the upstream, the metrics are updated once it's in use
+func newBreaker(upstream string, conf *config.CircuitBreaker) *breaker {
+	b := &breaker{conf: *conf, upstream: upstream, state: breakerClosed}
+
+	if conf.MaxRequests > 0 {
+		b.slots = make(chan struct{}, conf.MaxRequests)
+	}
+
+	return b
+}
+
+// Changes state and updates the metrics, must be called with the lock held
+func (b *breaker) setState(state string) {
+	b.state = state
+	b.failures = 0
+	b.probes = 0
+	b.successes = 0
+
+	if !b.retired {
+		b.publish()
+	}
+}
+
+// Sets the state metric for the upstream to the state of this breaker, must be called with the lock held
+func (b *breaker) publish() {
+	for _, s := range breakerStates {
+		value := 0.0
+		if s == b.state {
+			value = 1
+		}
+
+		metricBreakerState.WithLabelValues(b.upstream, s).Set(value)
+	}
+}
+
+// Stops the breaker updating the metrics, and removes them in case the upstream has gone
+// A breaker still in use for the upstream sets them again
+func (b *breaker) retire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.retired = true
+
+	for _, s := range breakerStates {
+		metricBreakerState.DeleteLabelValues(b.upstream, s)
+	}
+}
+
+// Moves an open breaker to half-open once the open duration is over, must be called with the lock held
+func (b *breaker) update(now time.Time) {
+	if b.state == breakerOpen && !now.Before(b.openUntil) {
+		slog.Info("Circuit breaker half-open, sending probe requests", "upstream", b.upstream)
+		b.setState(breakerHalfOpen)
+	}
+}
+
+// Admits a request to the upstream, or returns an error saying why it was rejected
+// When admitted, release must be called with the result once the request is done
+func (b *breaker) acquire(ctx context.Context) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+
+	b.mu.Lock()
+	b.update(time.Now())
+
+	probe := false
+
+	switch b.state {
+	case breakerOpen:
+		b.mu.Unlock()
+		metricBreakerRejected.WithLabelValues(b.upstream, breakerOpen).Inc()
+
+		return false, errBreakerOpen
+	case breakerHalfOpen:
+		if b.probes >= b.conf.HalfOpenRequests {
+			b.mu.Unlock()
+			metricBreakerRejected.WithLabelValues(b.upstream, breakerOpen).Inc()
+
+			return false, errBreakerOpen
+		}
+
+		b.probes++
+		probe = true
+	}
+
+	b.mu.Unlock()
+
+	err := b.takeSlot(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		if probe && b.state == breakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+
+		metricBreakerRejected.WithLabelValues(b.upstream, "max-requests").Inc()
+
+		return false, err
+	}
+
+	b.active++
+
+	return probe, nil
+}
+
+// Waits for a free slot when there is a limit on requests in flight, up to the pending limit & timeout
+func (b *breaker) takeSlot(ctx context.Context) error {
+	if b.slots == nil {
+		return nil
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	b.mu.Lock()
+
+	if b.pending >= b.conf.MaxPending {
+		b.mu.Unlock()
+		return errBreakerFull
+	}
+
+	b.pending++
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.pending--
+		b.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(b.conf.PendingTimeout)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errBreakerFull
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Records the result of an admitted request, which may open or close the breaker
+func (b *breaker) release(probe bool, failed bool) {
+	if b == nil {
+		return
+	}
+
+	if b.slots != nil {
+		<-b.slots
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active--
+	now := time.Now()
+
+	switch {
+	case probe && b.state == breakerHalfOpen:
+		b.probes--
+
+		if failed {
+			slog.Warn("Circuit breaker probe failed, opening again", "upstream", b.upstream)
+			b.open(now)
+
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.conf.HalfOpenRequests {
+			slog.Info("Circuit breaker closed", "upstream", b.upstream)
+			b.setState(breakerClosed)
+		}
+	case b.state == breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.conf.FailureThreshold {
+			slog.Warn("Circuit breaker opened", "upstream", b.upstream, "failures", b.failures,
+				"duration", b.conf.OpenDuration)
+			b.open(now)
+		}
+	}
+}
+
+// Opens the breaker for the open duration, must be called with the lock held
+func (b *breaker) open(now time.Time) {
+	b.setState(breakerOpen)
+	b.openUntil = now.Add(b.conf.OpenDuration)
+}
+
+// Snapshot of the current state of the breaker, nil when there's no breaker
+func (b *breaker) status() *breakerStatus {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.update(time.Now())
+
+	return &breakerStatus{State: b.state, Failures: b.failures, Active: b.active, Pending: b.pending}
+}
+
+// Checks if a proxied request counts as a failure for the breaker, the client going away doesn't count
+func breakerFailure(info *proxyInfo) bool {
+	if info.err != nil {
+		return !errors.Is(info.err, context.Canceled)
+	}
+
+	return info.status >= 500
+}
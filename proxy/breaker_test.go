@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func breakerState(t *testing.T, np *NanoProxy) string {
+	t.Helper()
+
+	response := httptest.NewRecorder()
+	np.upstreamsHandler(response, httptest.NewRequest(http.MethodGet, "/.nanoproxy/upstreams", nil))
+
+	statuses := []upstreamStatus{}
+	_ = json.Unmarshal(response.Body.Bytes(), &statuses)
+
+	if len(statuses) != 1 || statuses[0].CircuitBreaker == nil {
+		t.Fatalf("Expected circuit breaker status, got %s", response.Body.String())
+	}
+
+	return statuses[0].CircuitBreaker.State
+}
+
+func proxyGet(np *NanoProxy) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	return response
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	var hits atomic.Int32
+
+	var failing atomic.Bool
+
+	failing.Store(true)
+
+	backend := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:           "guarded",
+		Targets:        []config.Target{backend},
+		CircuitBreaker: &config.CircuitBreaker{FailureThreshold: 2, OpenDuration: 50 * time.Millisecond},
+	}, config.Rule{Path: "/"})
+
+	for i := 0; i < 2; i++ {
+		if code := proxyGet(np).Code; code != http.StatusInternalServerError {
+			t.Fatalf("Expected 500 from the upstream, got %d", code)
+		}
+	}
+
+	// Now open, requests are rejected without reaching the upstream
+	response := proxyGet(np)
+	if response.Code != http.StatusServiceUnavailable || response.Body.String() != errBreakerOpen.Error() {
+		t.Errorf("Expected fast 503 when open, got %d '%s'", response.Code, response.Body.String())
+	}
+
+	if hits.Load() != 2 || breakerState(t, np) != breakerOpen {
+		t.Errorf("Expected breaker to be open after 2 failures, upstream got %d requests", hits.Load())
+	}
+
+	// A failing probe opens it again
+	time.Sleep(60 * time.Millisecond)
+
+	if breakerState(t, np) != breakerHalfOpen {
+		t.Errorf("Expected breaker to be half-open after the open duration")
+	}
+
+	if code := proxyGet(np).Code; code != http.StatusInternalServerError || breakerState(t, np) != breakerOpen {
+		t.Errorf("Expected failed probe to open the breaker again, got %d", code)
+	}
+
+	// A good probe closes it
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+
+	if code := proxyGet(np).Code; code != http.StatusOK || breakerState(t, np) != breakerClosed {
+		t.Errorf("Expected successful probe to close the breaker, got %d", code)
+	}
+}
+
+func TestBreakerMaxRequests(t *testing.T) {
+	release := make(chan struct{})
+
+	var started sync.WaitGroup
+
+	backend := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	})
+
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:           "guarded",
+		Targets:        []config.Target{backend},
+		CircuitBreaker: &config.CircuitBreaker{MaxRequests: 1, MaxPending: 1, PendingTimeout: time.Second},
+	}, config.Rule{Path: "/"})
+
+	codes := make(chan int, 2)
+
+	// First request holds the only slot
+	started.Add(1)
+
+	go func() { codes <- proxyGet(np).Code }()
+
+	started.Wait()
+
+	// Second request waits in the queue
+	started.Add(1)
+
+	go func() { codes <- proxyGet(np).Code }()
+
+	waitFor(t, "request to be pending", func() bool {
+		return np.current().upstreams["guarded"].breaker.status().Pending == 1
+	})
+
+	// Third request has nowhere to go
+	response := proxyGet(np)
+	if response.Code != http.StatusServiceUnavailable || response.Body.String() != errBreakerFull.Error() {
+		t.Errorf("Expected fast 503 when full, got %d '%s'", response.Code, response.Body.String())
+	}
+
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected queued requests to succeed, got %d", code)
+		}
+	}
+}
+
+func TestBreakerKeptAcrossReload(t *testing.T) {
+	backend := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	conf := func(threshold int) *config.Config {
+		return &config.Config{
+			Upstreams: []config.Upstream{{
+				Name:           "breaker-reload",
+				Targets:        []config.Target{backend},
+				CircuitBreaker: &config.CircuitBreaker{FailureThreshold: threshold, OpenDuration: time.Hour},
+			}},
+			Rules: []config.Rule{{Path: "/", Upstream: "breaker-reload"}},
+		}
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, conf(1))
+	proxyGet(np)
+
+	// Reloading the same config, as the controller does on every change, keeps the breaker open
+	mustApplyConfig(t, np, conf(1))
+
+	if state := breakerState(t, np); state != breakerOpen {
+		t.Errorf("Expected breaker to stay open after reload, got %s", state)
+	}
+
+	if code := proxyGet(np).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from the open breaker after reload, got %d", code)
+	}
+
+	// Changing the settings starts a new breaker, and the metric follows it
+	mustApplyConfig(t, np, conf(2))
+
+	if state := breakerState(t, np); state != breakerClosed {
+		t.Errorf("Expected a closed breaker once its settings changed, got %s", state)
+	}
+
+	open := testutil.ToFloat64(metricBreakerState.WithLabelValues("breaker-reload", breakerOpen))
+	closed := testutil.ToFloat64(metricBreakerState.WithLabelValues("breaker-reload", breakerClosed))
+
+	if open != 0 || closed != 1 {
+		t.Errorf("Expected state metric to show closed, got open=%v closed=%v", open, closed)
+	}
+}
@@ -0,0 +1,280 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy command line subcommands, for checking config files offline
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+const usage = `Usage: nanoproxy [command]
+
+Run with no command to start the proxy. Commands:
+  validate [-json] [file]                    Check a config file, exits with 1 if it is invalid
+  dump [file]                                Print the config with all the defaults filled in
+  explain [flags] host [path]                Show which rule & upstream a request would be routed to
+    -config file, -json, -method GET, -header 'Name: value' (can be repeated)
+
+When no file is given the CONF_FILE env var or ./config.yaml is used
+`
+
+// Result of validating a config file
+type validateReport struct {
+	File     string                   `json:"file"`
+	Valid    bool                     `json:"valid"`
+	Errors   []config.ValidationError `json:"errors"`
+	Warnings []config.ValidationError `json:"warnings"`
+}
+
+// Flag which can be given more than once, e.g. -header 'A: 1' -header 'B: 2'
+type multiFlag []string
+
+func (f *multiFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Runs one of the CLI commands and returns the exit code
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "validate":
+		return validateCommand(args[1:], stdout, stderr)
+	case "dump":
+		return dumpCommand(args[1:], stdout, stderr)
+	case "explain":
+		return explainCommand(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		_, _ = fmt.Fprint(stdout, usage)
+		return 0
+	}
+
+	_, _ = fmt.Fprintf(stderr, "Unknown command: %s\n\n%s", args[0], usage)
+
+	return 2
+}
+
+// Checks a config file, reporting all the problems found
+func validateCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	jsonOut := flags.Bool("json", false, "output the report as JSON")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := config.GetPath()
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+
+	report := validateReport{File: path, Errors: []config.ValidationError{}, Warnings: []config.ValidationError{}}
+
+	// Unlike the proxy, unknown keys are reported, as they are usually typos
+	conf, err := config.LoadFileStrict(path)
+	if err == nil {
+		_, err = newSnapshot(conf, 0, &sharedState{})
+	}
+
+	if err == nil {
+		report.Warnings = conf.Warnings()
+	} else {
+		var validationErrs config.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			report.Errors = validationErrs
+		} else {
+			report.Errors = append(report.Errors, config.ValidationError{Message: err.Error()})
+		}
+	}
+
+	report.Valid = len(report.Errors) == 0
+
+	if *jsonOut {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else if report.Valid {
+		_, _ = fmt.Fprintf(stdout, "Config file %s is valid\n", path)
+
+		// Warnings don't stop the config being used, so they don't change the exit code
+		for _, w := range report.Warnings {
+			_, _ = fmt.Fprintf(stdout, "  - warning: %s\n", w.Error())
+		}
+	} else {
+		_, _ = fmt.Fprintf(stdout, "Config file %s is invalid, %d problem(s) found:\n", path, len(report.Errors))
+
+		for _, e := range report.Errors {
+			if e.Field == "" {
+				_, _ = fmt.Fprintf(stdout, "  - %s\n", e.Message)
+			} else {
+				_, _ = fmt.Fprintf(stdout, "  - %s\n", e.Error())
+			}
+		}
+	}
+
+	if !report.Valid {
+		return 1
+	}
+
+	return 0
+}
+
+// Prints the effective config, as the proxy would use it with defaults filled in
+func dumpCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path := config.GetPath()
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+
+	state, err := loadSnapshot(path)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Config file %s is invalid: %v\n", path, err)
+		return 1
+	}
+
+	_, _ = fmt.Fprint(stdout, normaliseConfig(*state.config).Dump())
+
+	return 0
+}
+
+// Shows which rule, upstream & target a request would be routed to, and why other rules were rejected
+func explainCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	jsonOut := flags.Bool("json", false, "output the result as JSON")
+	path := flags.String("config", config.GetPath(), "config file to load")
+	method := flags.String("method", http.MethodGet, "HTTP method of the request")
+	headers := multiFlag{}
+	flags.Var(&headers, "header", "request header in the form 'Name: value', can be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() < 1 {
+		_, _ = fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	r, err := explainRequest(*method, flags.Arg(0), flags.Arg(1), headers)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Invalid request: %v\n", err)
+		return 2
+	}
+
+	state, err := loadSnapshot(*path)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Config file %s is invalid: %v\n", *path, err)
+		return 1
+	}
+
+	result := state.explain(r)
+
+	if *jsonOut {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+	} else {
+		printExplain(stdout, result)
+	}
+
+	if result.Error != "" {
+		return 1
+	}
+
+	return 0
+}
+
+// Prints the explain result in a human readable form
+func printExplain(out io.Writer, result explainResult) {
+	_, _ = fmt.Fprintf(out, "Request:  %s %s%s\n", result.Method, result.Host, result.Path)
+	_, _ = fmt.Fprintf(out, "Rules checked, in order:\n")
+
+	for _, v := range result.Considered {
+		outcome := "matched"
+		if !v.Matched {
+			outcome = "rejected, " + v.Reason
+		}
+
+		_, _ = fmt.Fprintf(out, "  rules[%d] host: '%s' path: '%s' (%s) -> %s\n",
+			v.Index, v.Host, v.Path, v.MatchMode, outcome)
+	}
+
+	if result.Matched {
+		_, _ = fmt.Fprintf(out, "Rule:     rules[%d]\n", result.Rule.Index)
+		_, _ = fmt.Fprintf(out, "Upstream: %s\n", result.Upstream)
+	}
+
+	if result.Target != "" {
+		_, _ = fmt.Fprintf(out, "Target:   %s\n", result.Target)
+		_, _ = fmt.Fprintf(out, "URL:      %s\n", result.URL)
+	}
+
+	if result.Error != "" {
+		_, _ = fmt.Fprintf(out, "Result:   %s\n", result.Error)
+	}
+}
+
+// Loads a config file and builds a snapshot from it, which fails if the config is invalid
+// Health checks are not started, so nothing is sent to the upstreams
+func loadSnapshot(path string) (*snapshot, error) {
+	conf, err := config.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSnapshot(conf, 0, &sharedState{})
+}
+
+// Returns a copy of the config with all the defaults the proxy uses filled in
+func normaliseConfig(conf config.Config) config.Config {
+	norm := config.Config{Filepath: conf.Filepath}
+
+	for _, u := range conf.Upstreams {
+		norm.Upstreams = append(norm.Upstreams, upstreamDefaults(u))
+	}
+
+	for _, rule := range conf.Rules {
+		if rule.MatchMode == "" {
+			rule.MatchMode = matchPrefix
+		}
+
+		if rule.Upgrade != nil {
+			up := upgradeDefaults(*rule.Upgrade)
+			rule.Upgrade = &up
+		}
+
+		norm.Rules = append(norm.Rules, rule)
+	}
+
+	for _, l := range conf.Listeners {
+		if l.Mode == "" {
+			l.Mode = config.ListenerTCP
+		}
+
+		norm.Listeners = append(norm.Listeners, l)
+	}
+
+	return norm
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var cliConfig = `
+upstreams:
+  - name: api
+    host: api.internal
+  - name: web
+    scheme: https
+    targets:
+      - host: web1
+      - host: web2
+        port: 8443
+
+rules:
+  - upstream: api
+    path: /api
+    stripPath: true
+  - upstream: web
+    path: /
+`
+
+var cliBadConfig = `
+upstreams:
+  - name: api
+    host: api.internal
+    port: 99999
+
+rules:
+  - upstream: nope
+    path: /
+`
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func runCLI(args ...string) (int, string) {
+	out := &bytes.Buffer{}
+	code := runCommand(args, out, out)
+
+	return code, out.String()
+}
+
+func TestCommandValidate(t *testing.T) {
+	code, out := runCLI("validate", writeConfigFile(t, cliConfig))
+	if code != 0 || !strings.Contains(out, "is valid") {
+		t.Errorf("Expected valid config, got %d %s", code, out)
+	}
+
+	code, out = runCLI("validate", writeConfigFile(t, cliBadConfig))
+	if code != 1 || !strings.Contains(out, "upstreams[0].port") || !strings.Contains(out, "rules[0].upstream") {
+		t.Errorf("Expected invalid config, got %d %s", code, out)
+	}
+}
+
+func TestCommandValidateShadowed(t *testing.T) {
+	// Two rules for the same host & path, as two Ingresses would create, are a warning but not invalid
+	shadowed := cliConfig + `
+  - upstream: web
+    path: /
+`
+
+	code, out := runCLI("validate", writeConfigFile(t, shadowed))
+	if code != 0 || !strings.Contains(out, "is valid") || !strings.Contains(out, "shadowed by rules[") {
+		t.Errorf("Expected valid config with a warning, got %d %s", code, out)
+	}
+
+	code, out = runCLI("validate", "-json", writeConfigFile(t, shadowed))
+
+	report := validateReport{}
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+
+	if code != 0 || !report.Valid || len(report.Warnings) != 1 {
+		t.Errorf("Expected 1 warning, got %d %+v", code, report)
+	}
+}
+
+func TestCommandValidateUnknownKey(t *testing.T) {
+	code, out := runCLI("validate", writeConfigFile(t, cliConfig+"    stripPaths: true\n"))
+	if code != 1 || !strings.Contains(out, "stripPaths") {
+		t.Errorf("Expected unknown key to be reported, got %d %s", code, out)
+	}
+}
+
+func TestCommandValidateJSON(t *testing.T) {
+	code, out := runCLI("validate", "-json", writeConfigFile(t, cliBadConfig))
+	if code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+
+	report := validateReport{}
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+
+	if report.Valid || len(report.Errors) != 2 {
+		t.Errorf("Expected 2 errors, got %+v", report)
+	}
+
+	code, _ = runCLI("validate", "-json", filepath.Join(t.TempDir(), "missing.yaml"))
+	if code != 1 {
+		t.Errorf("Expected exit code 1 for missing file, got %d", code)
+	}
+}
+
+func TestCommandDump(t *testing.T) {
+	code, out := runCLI("dump", writeConfigFile(t, cliConfig))
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d %s", code, out)
+	}
+
+	defaults := []string{"port: 80", "port: 443", "port: 8443", "balancer: round-robin", "matchMode: prefix"}
+	for _, expected := range defaults {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected dump to contain '%s', got %s", expected, out)
+		}
+	}
+
+	code, _ = runCLI("dump", writeConfigFile(t, cliBadConfig))
+	if code != 1 {
+		t.Errorf("Expected exit code 1 for invalid config, got %d", code)
+	}
+}
+
+func TestCommandExplain(t *testing.T) {
+	path := writeConfigFile(t, cliConfig)
+
+	code, out := runCLI("explain", "-json", "-config", path, "example.com", "/api/users")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d %s", code, out)
+	}
+
+	result := explainResult{}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+
+	if result.Rule == nil || result.Rule.Index != 0 || result.Upstream != "api" ||
+		result.URL != "http://api.internal:80/users" {
+		t.Errorf("Unexpected explain result %+v", result)
+	}
+
+	code, out = runCLI("explain", "-config", path, "example.com")
+	if code != 0 || !strings.Contains(out, "Upstream: web") || !strings.Contains(out, "https://web1:443/") {
+		t.Errorf("Expected route to web, got %d %s", code, out)
+	}
+
+	code, _ = runCLI("explain", "-config", writeConfigFile(t, "upstreams: []"), "example.com", "/")
+	if code != 1 {
+		t.Errorf("Expected exit code 1 for no match, got %d", code)
+	}
+}
+
+func TestCommandUnknown(t *testing.T) {
+	if code, _ := runCLI("cheese"); code != 2 {
+		t.Errorf("Expected exit code 2, got %d", code)
+	}
+}
@@ -0,0 +1,177 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy rule conditions, matching on method, headers, query and cookies
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Where in the request a condition looks for its value
+const (
+	inHeader = "header"
+	inQuery  = "query"
+	inCookie = "cookie"
+)
+
+// A condition is a compiled header, query or cookie match from a rule
+type condition struct {
+	in     string
+	name   string
+	value  string
+	regex  *regexp.Regexp
+	absent bool // The value must not be in the request
+}
+
+// Values from a request, the query & cookies are only parsed if a condition needs them
+// One of these is shared across all the routes checked for a request
+type requestValues struct {
+	req     *http.Request
+	query   url.Values
+	cookies []*http.Cookie
+}
+
+// Compiles the header, query & cookie matches in a rule into conditions
+func compileConditions(rule config.Rule) ([]condition, error) {
+	conditions := []condition{}
+
+	groups := []struct {
+		in      string
+		matches []config.Match
+	}{
+		{inHeader, rule.Headers},
+		{inQuery, rule.Query},
+		{inCookie, rule.Cookies},
+	}
+
+	for _, group := range groups {
+		for _, m := range group.matches {
+			if m.Name == "" {
+				return nil, fmt.Errorf("%s match has no name", group.in)
+			}
+
+			c := condition{in: group.in, name: m.Name, value: m.Value}
+
+			if m.Present != nil && !*m.Present {
+				if m.Value != "" || m.Regex != "" {
+					return nil, fmt.Errorf("%s match '%s' can't have a value when it must not be present", group.in, m.Name)
+				}
+
+				c.absent = true
+			}
+
+			if m.Regex != "" {
+				regex, err := regexp.Compile(m.Regex)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s match regex '%s': %v", group.in, m.Regex, err)
+				}
+
+				c.regex = regex
+			}
+
+			conditions = append(conditions, c)
+		}
+	}
+
+	return conditions, nil
+}
+
+// Checks the request method and conditions of the route
+// Returns a reason when the request does not match, or an empty string when it does
+func (rt *route) checkConditions(rv *requestValues) string {
+	if len(rt.methods) > 0 && !slices.Contains(rt.methods, rv.req.Method) {
+		return "method " + rv.req.Method + " not allowed"
+	}
+
+	for _, c := range rt.conditions {
+		if reason := c.check(rv); reason != "" {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+// Checks a single condition against the request, returning a reason if it fails
+func (c condition) check(rv *requestValues) string {
+	values := rv.get(c.in, c.name)
+
+	if c.absent {
+		if len(values) > 0 {
+			return fmt.Sprintf("%s '%s' is present", c.in, c.name)
+		}
+
+		return ""
+	}
+
+	if len(values) == 0 {
+		return fmt.Sprintf("%s '%s' is missing", c.in, c.name)
+	}
+
+	// With no value or regex, the condition only needs the value to be present
+	if c.value == "" && c.regex == nil {
+		return ""
+	}
+
+	for _, v := range values {
+		if c.regex != nil && c.regex.MatchString(v) {
+			return ""
+		}
+
+		if c.value != "" && v == c.value {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("%s '%s' does not match", c.in, c.name)
+}
+
+// Gets all the values for a header, query parameter or cookie in the request
+func (rv *requestValues) get(in string, name string) []string {
+	switch in {
+	case inHeader:
+		return rv.req.Header.Values(name)
+	case inQuery:
+		if rv.query == nil {
+			rv.query = rv.req.URL.Query()
+		}
+
+		return rv.query[name]
+	case inCookie:
+		if rv.cookies == nil {
+			rv.cookies = rv.req.Cookies()
+		}
+
+		values := []string{}
+
+		for _, cookie := range rv.cookies {
+			if cookie.Name == name {
+				values = append(values, cookie.Value)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+// Normalises the methods in a rule to upper case
+func compileMethods(methods []string) []string {
+	compiled := make([]string, 0, len(methods))
+
+	for _, m := range methods {
+		compiled = append(compiled, strings.ToUpper(strings.TrimSpace(m)))
+	}
+
+	return compiled
+}
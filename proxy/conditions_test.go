@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+func TestConditions(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		name  string
+		rule  config.Rule
+		setup func(r *http.Request)
+		match bool
+	}{
+		{"method allowed", config.Rule{Methods: []string{"get", "HEAD"}}, nil, true},
+		{"method not allowed", config.Rule{Methods: []string{"POST"}}, nil, false},
+		{
+			"header exact",
+			config.Rule{Headers: []config.Match{{Name: "x-canary", Value: "true"}}},
+			func(r *http.Request) { r.Header.Set("X-Canary", "true") },
+			true,
+		},
+		{
+			"header exact wrong value",
+			config.Rule{Headers: []config.Match{{Name: "X-Canary", Value: "true"}}},
+			func(r *http.Request) { r.Header.Set("X-Canary", "false") },
+			false,
+		},
+		{
+			"header regex",
+			config.Rule{Headers: []config.Match{{Name: "User-Agent", Regex: "(?i)mobile"}}},
+			func(r *http.Request) { r.Header.Set("User-Agent", "Some Mobile Browser") },
+			true,
+		},
+		{"header present missing", config.Rule{Headers: []config.Match{{Name: "Authorization"}}}, nil, false},
+		{
+			"header present",
+			config.Rule{Headers: []config.Match{{Name: "Authorization", Present: &yes}}},
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer x") },
+			true,
+		},
+		{
+			"header absent",
+			config.Rule{Headers: []config.Match{{Name: "Authorization", Present: &no}}},
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer x") },
+			false,
+		},
+		{
+			"query value",
+			config.Rule{Query: []config.Match{{Name: "version", Value: "2"}}},
+			func(r *http.Request) { r.URL.RawQuery = "a=1&version=2" },
+			true,
+		},
+		{
+			"cookie regex",
+			config.Rule{Cookies: []config.Match{{Name: "group", Regex: "^beta-"}}},
+			func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "group", Value: "beta-testers"}) },
+			true,
+		},
+		{
+			"cookie missing",
+			config.Rule{Cookies: []config.Match{{Name: "group", Regex: "^beta-"}}},
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		test.rule.Path = "/"
+
+		rt, err := compileRoute(test.rule)
+		if err != nil {
+			t.Fatalf("%s: unexpected error compiling rule: %v", test.name, err)
+		}
+
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if test.setup != nil {
+			test.setup(request)
+		}
+
+		reason := rt.checkConditions(&requestValues{req: request})
+		if (reason == "") != test.match {
+			t.Errorf("%s: expected match to be %v, got reason '%s'", test.name, test.match, reason)
+		}
+	}
+}
+
+func TestConditionsInvalid(t *testing.T) {
+	no := false
+
+	bad := []config.Rule{
+		{Path: "/", Headers: []config.Match{{Value: "no-name"}}},
+		{Path: "/", Query: []config.Match{{Name: "q", Regex: "(bad"}}},
+		{Path: "/", Cookies: []config.Match{{Name: "c", Value: "x", Present: &no}}},
+	}
+
+	for _, rule := range bad {
+		if _, err := compileRoute(rule); err == nil {
+			t.Errorf("Expected error compiling rule %+v", rule)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy route explain, a dry run showing how a request would be routed
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Where a request would be routed, and why
+type explainResult struct {
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	Matched    bool          `json:"matched"`
+	Rule       *ruleVerdict  `json:"rule,omitempty"`
+	Upstream   string        `json:"upstream,omitempty"`
+	Target     string        `json:"target,omitempty"`
+	URL        string        `json:"url,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Considered []ruleVerdict `json:"considered"`
+}
+
+// A rule that was checked against the request, and the reason it was rejected
+type ruleVerdict struct {
+	Index     int    `json:"index"`
+	Host      string `json:"host,omitempty"`
+	Path      string `json:"path"`
+	MatchMode string `json:"matchMode"`
+	Priority  int    `json:"priority,omitempty"`
+	Upstream  string `json:"upstream"`
+	Matched   bool   `json:"matched"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Works out where a request would be routed, without sending it anywhere
+// The rules are listed in the order they are checked, up to the one that matched
+func (s *snapshot) explain(r *http.Request) explainResult {
+	result := explainResult{
+		Method:     r.Method,
+		Host:       requestHostname(r),
+		Path:       r.URL.Path,
+		Considered: []ruleVerdict{},
+	}
+
+	values := &requestValues{req: r}
+
+	// Routing is done exactly as the main handler does it, but as a dry run so the balancers aren't moved on
+	d := s.resolve(r, values, true)
+
+	// Then walk all routes in order, to give the reason each was rejected
+	for _, rt := range s.routes {
+		verdict := ruleVerdict{
+			Index:     rt.index,
+			Host:      rt.rule.Host,
+			Path:      rt.rule.Path,
+			MatchMode: rt.mode,
+			Priority:  rt.rule.Priority,
+			Upstream:  rt.rule.Upstream,
+		}
+
+		switch {
+		case !rt.matchHost(result.Host):
+			verdict.Reason = fmt.Sprintf("host '%s' does not match", result.Host)
+		case rt.matchPath(r.URL.Path) == nil:
+			verdict.Reason = fmt.Sprintf("path '%s' does not match", r.URL.Path)
+		default:
+			verdict.Reason = rt.checkConditions(values)
+		}
+
+		if d.match != nil && rt == d.match.route {
+			verdict.Matched = true
+			verdict.Reason = ""
+			result.Considered = append(result.Considered, verdict)
+			result.Rule = &verdict
+
+			break
+		}
+
+		result.Considered = append(result.Considered, verdict)
+	}
+
+	if d.match == nil {
+		result.Error = "No matching rule for host & path"
+		return result
+	}
+
+	result.Matched = true
+	result.Upstream = d.upstream.name
+
+	if d.target == nil {
+		result.Error = "No targets available for upstream"
+		return result
+	}
+
+	upstreamURL := *d.target.url
+	upstreamURL.Path = d.path
+	upstreamURL.RawQuery = r.URL.RawQuery
+
+	result.Target = d.target.url.String()
+	result.URL = upstreamURL.String()
+
+	return result
+}
+
+// Builds the request to explain, from the method, host, path and headers given
+// Headers are in the form 'Name: value'
+func explainRequest(method, host, path string, headers []string) (*http.Request, error) {
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	r, err := http.NewRequest(strings.ToUpper(method), "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range headers {
+		name, value, found := strings.Cut(h, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid header '%s', expected 'Name: value'", h)
+		}
+
+		r.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	return r, nil
+}
+
+// Explains how a request would be routed, the request is described with query parameters
+// e.g. /.nanoproxy/explain?method=POST&host=example.net&path=/api&header=X-Canary:true
+func (np *NanoProxy) explainHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	host := query.Get("host")
+	if host == "" {
+		host = r.Host
+	}
+
+	req, err := explainRequest(query.Get("method"), host, query.Get("path"), query["header"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(np.current().explain(req))
+}
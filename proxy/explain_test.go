@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+var explainConf = config.Config{
+	Upstreams: []config.Upstream{
+		{Name: "api", Host: "api.internal"},
+		{Name: "canary", Host: "canary.internal"},
+		{Name: "web", Host: "web.internal"},
+	},
+	Rules: []config.Rule{
+		{Upstream: "web", Path: "/"},
+		{Upstream: "api", Path: "/api", Host: "example.net", StripPath: true},
+		{Upstream: "canary", Path: "/api", Host: "example.net", Headers: []config.Match{{Name: "X-Canary", Value: "true"}}},
+		{Upstream: "api", Path: "/admin", Host: "admin.example.net"},
+	},
+}
+
+func explainJSON(t *testing.T, np *NanoProxy, query string) explainResult {
+	t.Setenv("DEBUG", "1")
+
+	request, _ := http.NewRequest(http.MethodGet, "/.nanoproxy/explain?"+query, nil)
+	response := httptest.NewRecorder()
+
+	np.createRoutes().ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", response.Code, response.Body.String())
+	}
+
+	result := explainResult{}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+
+	return result
+}
+
+func TestExplainEndpoint(t *testing.T) {
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &explainConf)
+
+	result := explainJSON(t, np, "host=example.net&path=/api/users?id=1")
+	if !result.Matched || result.Rule.Index != 1 || result.URL != "http://api.internal:80/users?id=1" {
+		t.Errorf("Expected rules[1] to match, got %+v", result)
+	}
+
+	// The canary rule is more specific so it is checked first, and rejected for the missing header
+	if len(result.Considered) != 3 || result.Considered[1].Index != 2 ||
+		!strings.Contains(result.Considered[1].Reason, "X-Canary") {
+		t.Errorf("Expected canary rule to be rejected first, got %+v", result.Considered)
+	}
+
+	result = explainJSON(t, np, "host=example.net&path=/api&header=X-Canary:true")
+	if result.Upstream != "canary" || len(result.Considered) != 2 {
+		t.Errorf("Expected canary upstream, got %+v", result)
+	}
+
+	result = explainJSON(t, np, "host=other.net&path=/api")
+	if result.Upstream != "web" || result.URL != "http://web.internal:80/api" {
+		t.Errorf("Expected web upstream, got %+v", result)
+	}
+
+	for _, v := range result.Considered[:len(result.Considered)-1] {
+		if !strings.Contains(v.Reason, "host 'other.net' does not match") {
+			t.Errorf("Expected host rejection reason, got %+v", v)
+		}
+	}
+}
+
+func TestExplainNoMatch(t *testing.T) {
+	conf := config.Config{
+		Upstreams: explainConf.Upstreams,
+		Rules:     []config.Rule{{Upstream: "api", Path: "/api", MatchMode: matchExact, Methods: []string{"POST"}}},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	result := explainJSON(t, np, "path=/api/x")
+	if result.Matched || result.Error == "" || len(result.Considered) != 1 {
+		t.Errorf("Expected no match, got %+v", result)
+	}
+
+	if result.Considered[0].Reason != "path '/api/x' does not match" {
+		t.Errorf("Unexpected reason: %s", result.Considered[0].Reason)
+	}
+
+	result = explainJSON(t, np, "path=/api&method=get")
+	if result.Considered[0].Reason != "method GET not allowed" {
+		t.Errorf("Unexpected reason: %s", result.Considered[0].Reason)
+	}
+
+	result = explainJSON(t, np, "path=/api&method=post")
+	if !result.Matched {
+		t.Errorf("Expected POST to match, got %+v", result)
+	}
+}
+
+func TestExplainBadHeader(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "/.nanoproxy/explain?header=nocolon", nil)
+	response := httptest.NewRecorder()
+
+	nanoProxy.explainHandler(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", response.Code)
+	}
+}
+
+func TestExplainNeedsDebug(t *testing.T) {
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, nil)
+
+	for _, path := range []string{"/.nanoproxy/explain?path=/", "/.nanoproxy/upstreams"} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+
+		np.createRoutes().ServeHTTP(response, request)
+
+		if response.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to be disabled without DEBUG, got %d", path, response.Code)
+		}
+	}
+}
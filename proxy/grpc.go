@@ -0,0 +1,97 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy gRPC support, errors from the proxy are sent as gRPC statuses
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used for errors from the proxy
+// See https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+	grpcContentTypePrefix = "application/grpc"
+)
+
+// Checks if the request is a gRPC call, from the content type
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentTypePrefix)
+}
+
+// Maps the HTTP status of an error from the proxy to a gRPC status code
+// Follows https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md except that
+// timeouts are a deadline exceeded, as it's the proxy which gave up waiting
+func grpcStatus(httpStatus int) int {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+
+	return grpcUnknown
+}
+
+// Sends an error response from the proxy with the request ID
+// gRPC clients get a trailers-only response with the gRPC status, as they can't make sense of HTTP errors
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if id := requestIDFromContext(r.Context()); id != nil {
+		w.Header().Set(id.header, id.value)
+	}
+
+	if isGRPC(r) {
+		if message == "" {
+			message = http.StatusText(status)
+		}
+
+		w.Header().Set("Content-Type", grpcContentTypePrefix)
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatus(status)))
+		w.Header().Set("Grpc-Message", grpcEncodeMessage(message))
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	w.WriteHeader(status)
+
+	if message != "" {
+		_, _ = w.Write([]byte(message))
+	}
+}
+
+// Percent encodes a grpc-message, as required for anything outside printable ASCII and '%' itself
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Backend which acts like a gRPC server, it only speaks h2c and sends the status in trailers
+func newGRPCBackend(t *testing.T) config.Target {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !isGRPC(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = w.Write(body)
+
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", r.URL.Path)
+	}))
+
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return serverTarget(server)
+}
+
+// Client which only speaks h2c, like a gRPC client with a plaintext connection
+func newH2CClient() *http.Client {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func grpcCall(t *testing.T, client *http.Client, url string) *http.Response {
+	t.Helper()
+
+	request, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader([]byte("ping")))
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("gRPC call to %s failed: %v", url, err)
+	}
+
+	t.Cleanup(func() { _ = response.Body.Close() })
+
+	return response
+}
+
+func TestGRPCProxy(t *testing.T) {
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "greeter", Targets: []config.Target{newGRPCBackend(t)}, Protocol: config.ProtocolH2C},
+			{Name: "dead", Targets: []config.Target{newDeadBackend(t)}, Protocol: config.ProtocolH2C},
+		},
+		Rules: []config.Rule{
+			{Upstream: "greeter", GRPC: &config.GRPCMatch{Service: "helloworld.Greeter"}},
+			{Upstream: "dead", GRPC: &config.GRPCMatch{Service: "helloworld.Greeter", Method: "Broken"}},
+		},
+	})
+
+	// Serve with the same protocols as the real proxy server
+	proxy := httptest.NewUnstartedServer(np.createRoutes())
+	proxy.Config.Protocols = serverProtocols()
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	client := newH2CClient()
+
+	response := grpcCall(t, client, proxy.URL+"/helloworld.Greeter/SayHello")
+	body, _ := io.ReadAll(response.Body)
+
+	if response.ProtoMajor != 2 || string(body) != "ping" {
+		t.Errorf("Expected HTTP/2 response with the body, got %s '%s'", response.Proto, body)
+	}
+
+	// Trailers are only available once the body has been read
+	trailer := response.Trailer
+	if trailer.Get("Grpc-Status") != "0" || trailer.Get("Grpc-Message") != "/helloworld.Greeter/SayHello" {
+		t.Errorf("Expected gRPC trailers to be passed through, got %v", response.Trailer)
+	}
+
+	// Failures from the proxy are sent as gRPC statuses
+	tests := map[string]string{
+		"/helloworld.Greeter/Broken": "14", // Upstream unavailable
+		"/other.Service/Method":      "12", // No matching rule, so unimplemented
+	}
+
+	for path, status := range tests {
+		response := grpcCall(t, client, proxy.URL+path)
+
+		if response.StatusCode != http.StatusOK || response.Header.Get("Grpc-Status") != status {
+			t.Errorf("%s: expected gRPC status %s, got %d %v", path, status, response.StatusCode, response.Header)
+		}
+	}
+
+	// Plain HTTP requests don't match gRPC rules
+	request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/helloworld.Greeter/SayHello", nil)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected non gRPC request not to match, got %v", err)
+	}
+
+	_ = response.Body.Close()
+}
+
+func TestGRPCOverTLS(t *testing.T) {
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "greeter", Targets: []config.Target{newGRPCBackend(t)}, Protocol: config.ProtocolH2C},
+		},
+		Rules: []config.Rule{{Upstream: "greeter", GRPC: &config.GRPCMatch{}}},
+	})
+
+	proxy := httptest.NewUnstartedServer(np.createRoutes())
+	proxy.Config.Protocols = serverProtocols()
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	t.Cleanup(proxy.Close)
+
+	client := proxy.Client()
+	client.Transport.(*http.Transport).DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		//nolint:gosec
+		return tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	}
+
+	response := grpcCall(t, client, proxy.URL+"/helloworld.Greeter/SayHello")
+	_, _ = io.ReadAll(response.Body)
+
+	if response.ProtoMajor != 2 || response.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected gRPC over TLS with HTTP/2, got %s %v", response.Proto, response.Trailer)
+	}
+}
+
+func TestGRPCStreamOutlivesServerTimeout(t *testing.T) {
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "greeter", Targets: []config.Target{newGRPCBackend(t)}, Protocol: config.ProtocolH2C},
+		},
+		Rules: []config.Rule{{Upstream: "greeter", GRPC: &config.GRPCMatch{}}},
+	})
+
+	// The same server as the real proxy, with a short timeout
+	proxy := httptest.NewUnstartedServer(nil)
+	proxy.Config = np.newServer("", 50*time.Millisecond)
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	// Client streaming call, which sends messages for longer than the server timeout
+	body, writer := io.Pipe()
+
+	go func() {
+		_, _ = writer.Write([]byte("ping"))
+
+		time.Sleep(200 * time.Millisecond)
+
+		_, _ = writer.Write([]byte("pong"))
+		_ = writer.Close()
+	}()
+
+	request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/helloworld.Greeter/Chat", body)
+	request.Header.Set("Content-Type", "application/grpc")
+
+	response, err := newH2CClient().Do(request)
+	if err != nil {
+		t.Fatalf("Streaming call failed: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	received, _ := io.ReadAll(response.Body)
+	if string(received) != "pingpong" || response.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected the whole stream echoed back, got '%s' status '%s'", received,
+			response.Trailer.Get("Grpc-Status"))
+	}
+}
@@ -0,0 +1,206 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy active health checks, probing upstream targets in the background
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Defaults for any health check settings not set in the config
+const (
+	healthDefaultPath      = "/"
+	healthDefaultInterval  = 10 * time.Second
+	healthDefaultTimeout   = 2 * time.Second
+	healthDefaultHealthy   = 2
+	healthDefaultUnhealthy = 3
+)
+
+// Health states are shared by all snapshots of a proxy and looked up by upstream, target & check settings,
+// so a config reload doesn't forget which targets are unhealthy or ejected
+type healthCache struct {
+	mu     sync.Mutex
+	states map[string]*targetHealth
+}
+
+// Returns the health state for a target of the upstream, creating a healthy one if there isn't one
+// The upstream config must have its defaults filled in
+func (c *healthCache) get(u config.Upstream, target *url.URL) *targetHealth {
+	key := fmt.Sprintf("%s %s", u.Name, target.String())
+
+	if u.HealthCheck != nil {
+		key += fmt.Sprintf(" %+v", *u.HealthCheck)
+	}
+
+	if u.OutlierDetection != nil {
+		key += fmt.Sprintf(" %+v", *u.OutlierDetection)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.states == nil {
+		c.states = make(map[string]*targetHealth)
+	}
+
+	if h, ok := c.states[key]; ok {
+		return h
+	}
+
+	h := &targetHealth{}
+	h.healthy.Store(true)
+	c.states[key] = h
+
+	return h
+}
+
+// Drops the health states not used by the snapshot
+func (c *healthCache) retain(s *snapshot) {
+	used := make(map[*targetHealth]bool)
+
+	for _, up := range s.upstreams {
+		for _, t := range up.targets {
+			used[t.targetHealth] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, h := range c.states {
+		if !used[h] {
+			delete(c.states, key)
+		}
+	}
+}
+
+// Returns a copy of the health check config with defaults filled in
+func healthCheckDefaults(hc config.HealthCheck) config.HealthCheck {
+	if hc.Path == "" {
+		hc.Path = healthDefaultPath
+	}
+
+	if !strings.HasPrefix(hc.Path, "/") {
+		hc.Path = "/" + hc.Path
+	}
+
+	if hc.Interval <= 0 {
+		hc.Interval = healthDefaultInterval
+	}
+
+	if hc.Timeout <= 0 {
+		hc.Timeout = healthDefaultTimeout
+	}
+
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = healthDefaultHealthy
+	}
+
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = healthDefaultUnhealthy
+	}
+
+	return hc
+}
+
+// Starts a probe goroutine for each target in the upstream, they run until the context is cancelled
+func (u *upstream) startHealthChecks(ctx context.Context) {
+	if u.healthCheck == nil {
+		return
+	}
+
+	hc := *u.healthCheck
+
+	for _, t := range u.targets {
+		// Probes use the target's transport, so they share its connections which are closed when it's dropped
+		client := &http.Client{
+			Timeout:   hc.Timeout,
+			Transport: t.transport,
+			// Redirects are reported as the status code, not followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		go u.probeLoop(ctx, client, hc, t)
+	}
+}
+
+// Probes a single target on an interval, flipping its health after enough consecutive results
+func (u *upstream) probeLoop(ctx context.Context, client *http.Client, hc config.HealthCheck, t *target) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+
+	for {
+		ok := probe(ctx, client, hc, t)
+
+		// Config was reloaded or the proxy is stopping, don't report a result
+		if ctx.Err() != nil {
+			return
+		}
+
+		if ok {
+			successes++
+			failures = 0
+
+			if !t.healthy.Load() && successes >= hc.HealthyThreshold {
+				slog.Info("Health check: target is now healthy", "upstream", u.name, "target", t.url.String())
+				t.healthy.Store(true)
+			}
+		} else {
+			failures++
+			successes = 0
+
+			if t.healthy.Load() && failures >= hc.UnhealthyThreshold {
+				slog.Warn("Health check: target is now unhealthy", "upstream", u.name, "target", t.url.String())
+				t.healthy.Store(false)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends one probe request to the target, returns true if it passed
+func probe(ctx context.Context, client *http.Client, hc config.HealthCheck, t *target) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url.String()+hc.Path, nil)
+	if err != nil {
+		return false
+	}
+
+	req.Header.Set("User-Agent", proxyName+"/"+version+" health-check")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if hc.ExpectedStatus != 0 {
+		return resp.StatusCode == hc.ExpectedStatus
+	}
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Polls until the condition is true or the wait times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckDefaults(t *testing.T) {
+	hc := healthCheckDefaults(config.HealthCheck{Path: "healthz"})
+
+	if hc.Path != "/healthz" {
+		t.Errorf("Expected path /healthz, got %s", hc.Path)
+	}
+
+	if hc.Interval != healthDefaultInterval || hc.Timeout != healthDefaultTimeout {
+		t.Errorf("Expected default interval & timeout, got %v %v", hc.Interval, hc.Timeout)
+	}
+
+	if hc.HealthyThreshold != healthDefaultHealthy || hc.UnhealthyThreshold != healthDefaultUnhealthy {
+		t.Errorf("Expected default thresholds, got %d %d", hc.HealthyThreshold, hc.UnhealthyThreshold)
+	}
+}
+
+func TestHealthCheckRemovesTarget(t *testing.T) {
+	var failing atomic.Bool
+
+	sick := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = w.Write([]byte("sick"))
+	})
+
+	conf := config.Config{
+		Rules: []config.Rule{
+			{Path: "/", Upstream: "backends"},
+		},
+		Upstreams: []config.Upstream{
+			{
+				Name:    "backends",
+				Targets: []config.Target{sick, newBackend(t, "well")},
+				HealthCheck: &config.HealthCheck{
+					Path:               "/healthz",
+					Interval:           10 * time.Millisecond,
+					HealthyThreshold:   1,
+					UnhealthyThreshold: 1,
+				},
+			},
+		},
+	}
+
+	failing.Store(true)
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+	t.Cleanup(func() { np.applyConfig(nil, timeout) })
+
+	up := np.current().upstreams["backends"]
+	waitFor(t, "target to become unhealthy", func() bool { return !up.targets[0].healthy.Load() })
+
+	// Only the healthy target should get traffic now
+	for i := 0; i < 4; i++ {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		response := httptest.NewRecorder()
+
+		np.mainHandler(response, request)
+
+		if response.Body.String() != "well" {
+			t.Errorf("Expected request to go to healthy target, got %s", response.Body.String())
+		}
+	}
+
+	// Check the state is visible on the admin endpoint
+	t.Setenv("DEBUG", "1")
+
+	request, _ := http.NewRequest(http.MethodGet, "/.nanoproxy/upstreams", nil)
+	response := httptest.NewRecorder()
+	np.createRoutes().ServeHTTP(response, request)
+
+	statuses := []upstreamStatus{}
+	if err := json.Unmarshal(response.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Expected JSON from upstreams endpoint, got %v", err)
+	}
+
+	if len(statuses) != 1 || statuses[0].Targets[0].Healthy || !statuses[0].Targets[1].Healthy {
+		t.Errorf("Expected first target unhealthy and second healthy, got %+v", statuses)
+	}
+
+	// Recovers once the probe passes again
+	failing.Store(false)
+	waitFor(t, "target to become healthy", func() bool { return up.targets[0].healthy.Load() })
+}
+
+func TestHealthKeptAcrossReload(t *testing.T) {
+	conf := config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "backends", Targets: []config.Target{newBackend(t, "a")}, OutlierDetection: &config.OutlierDetection{}},
+		},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+	t.Cleanup(func() { np.applyConfig(nil, timeout) })
+
+	old := np.current().upstreams["backends"].targets[0]
+	old.healthy.Store(false)
+	old.ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+
+	// Another proxy keeps its own health states, so reloading it leaves these alone
+	mustApplyConfig(t, &NanoProxy{}, &config.Config{})
+
+	// Adding an unrelated upstream shouldn't put the sick target back in rotation
+	conf.Upstreams = append(conf.Upstreams, config.Upstream{Name: "other", Targets: []config.Target{newBackend(t, "b")}})
+	mustApplyConfig(t, np, &conf)
+
+	tgt := np.current().upstreams["backends"].targets[0]
+	if tgt == old || tgt.healthy.Load() || !tgt.ejected(time.Now()) {
+		t.Errorf("Expected target to stay unhealthy & ejected after reload")
+	}
+
+	// Changing the settings starts the target afresh
+	conf.Upstreams[0].OutlierDetection = &config.OutlierDetection{ConsecutiveErrors: 2}
+	mustApplyConfig(t, np, &conf)
+
+	tgt = np.current().upstreams["backends"].targets[0]
+	if !tgt.healthy.Load() || tgt.ejected(time.Now()) {
+		t.Errorf("Expected target to be healthy after its settings changed")
+	}
+}
+
+func TestHealthCheckReusesConnections(t *testing.T) {
+	var conns, probes atomic.Int64
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	conf := config.Config{
+		Upstreams: []config.Upstream{
+			{
+				Name:        "probed",
+				Targets:     []config.Target{serverTarget(server)},
+				HealthCheck: &config.HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond},
+			},
+		},
+	}
+
+	np := &NanoProxy{}
+	t.Cleanup(func() { np.applyConfig(nil, timeout) })
+
+	// Each reload starts new probes, which should carry on over the same kept-alive connection
+	for range 3 {
+		mustApplyConfig(t, np, &conf)
+
+		seen := probes.Load()
+		waitFor(t, "target to be probed", func() bool { return probes.Load() > seen })
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected probes to share one connection across reloads, got %d", n)
+	}
+}
@@ -0,0 +1,53 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy logging setup, using slog with a configurable level & format
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Sets the default slog logger from the LOG_LEVEL & LOG_FORMAT env vars, returning the level
+// Setting DEBUG is a shortcut for the debug level, the stdlib log package is sent through slog too
+// Lines logged with a request context include the request ID
+func setupLogging() (slog.Level, error) {
+	level := slog.LevelInfo
+
+	if os.Getenv("DEBUG") != "" {
+		level = slog.LevelDebug
+	}
+
+	if envLevel := os.Getenv("LOG_LEVEL"); envLevel != "" {
+		if err := level.UnmarshalText([]byte(envLevel)); err != nil {
+			return level, fmt.Errorf("invalid LOG_LEVEL: %s", envLevel)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return level, fmt.Errorf("invalid LOG_FORMAT: %s", format)
+	}
+
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+
+	return level, nil
+}
+
+// Logs an error and exits, for use at startup only
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	prev := slog.Default()
+
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		log.SetOutput(io.Discard)
+	})
+
+	tests := []struct {
+		debug, level, format string
+		expected             slog.Level
+		err                  bool
+	}{
+		{"", "", "", slog.LevelInfo, false},
+		{"1", "", "", slog.LevelDebug, false},
+		{"1", "error", "json", slog.LevelError, false},
+		{"", "WARN", "text", slog.LevelWarn, false},
+		{"", "loud", "", slog.LevelInfo, true},
+		{"", "", "xml", slog.LevelInfo, true},
+	}
+
+	for _, test := range tests {
+		t.Setenv("DEBUG", test.debug)
+		t.Setenv("LOG_LEVEL", test.level)
+		t.Setenv("LOG_FORMAT", test.format)
+
+		level, err := setupLogging()
+		if (err != nil) != test.err {
+			t.Errorf("%+v: unexpected error result %v", test, err)
+			continue
+		}
+
+		if !test.err && level != test.expected {
+			t.Errorf("%+v: expected level %v, got %v", test, test.expected, level)
+		}
+	}
+}
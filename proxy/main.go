@@ -6,8 +6,9 @@
 package main
 
 import (
+	"context"
 	b64 "encoding/base64"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"time"
@@ -19,7 +20,19 @@ import (
 var version = "0.0.0"
 
 func main() {
-	log.Printf("Starting NanoProxy version: %s", version)
+	// Run one of the CLI commands instead of the proxy, e.g. 'nanoproxy validate config.yaml'
+	if len(os.Args) > 1 {
+		// Commands report their own results, so the usual logging is not wanted
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	logLevel, err := setupLogging()
+	if err != nil {
+		fatal("Error setting up logging", "error", err)
+	}
+
+	slog.Info("Starting NanoProxy", "version", version, "logLevel", logLevel.String())
 
 	port := "8080"
 	timeout := 5 * time.Second
@@ -37,7 +50,7 @@ func main() {
 	if os.Getenv("TIMEOUT") != "" {
 		t, err := strconv.Atoi(os.Getenv("TIMEOUT"))
 		if err != nil {
-			log.Fatalf("Invalid timeout value: %s", os.Getenv("TIMEOUT"))
+			fatal("Invalid timeout value", "timeout", os.Getenv("TIMEOUT"))
 		}
 
 		timeout = time.Duration(t) * time.Second
@@ -46,29 +59,55 @@ func main() {
 	if os.Getenv("CONFIG_B64") != "" {
 		confBase64 := os.Getenv("CONFIG_B64")
 
-		log.Printf("Config provided from env variable")
+		slog.Info("Config provided from env variable")
 
 		// Decode as Base64
 		confBytes, err := b64.StdEncoding.DecodeString(confBase64)
 		if err != nil {
-			log.Fatalf("Error decoding base64 config: %v", err)
+			fatal("Error decoding base64 config", "error", err)
 		}
 
 		// Write decoded config to the config file
 		err = os.WriteFile(config.GetPath(), confBytes, 0600)
 		if err != nil {
-			log.Fatalf("Error writing config file: %v", err)
+			fatal("Error writing config file", "error", err)
 		}
 
-		log.Printf("Env var config file written to: %s", config.GetPath())
+		slog.Info("Env var config file written", "path", config.GetPath())
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Error setting up tracing", "error", err)
 	}
 
-	nanoProxy := &NanoProxy{}
+	if shutdownTracing != nil {
+		slog.Info("Tracing enabled, exporting spans with OTLP")
+
+		defer func() { _ = shutdownTracing(context.Background()) }()
+	}
+
+	accessLog, err := newAccessLoggerFromEnv()
+	if err != nil {
+		fatal("Error setting up access log", "error", err)
+	}
+
+	budget, err := newRetryBudgetFromEnv()
+	if err != nil {
+		fatal("Error setting up retry budget", "error", err)
+	}
+
+	nanoProxy := &NanoProxy{
+		accessLog: accessLog,
+		debug:     logLevel <= slog.LevelDebug,
+		idHeader:  os.Getenv("REQUEST_ID_HEADER"),
+		budget:    budget,
+	}
 
 	// Setup file watcher for config file
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error creating config file watcher", "error", err)
 	}
 	defer watcher.Close()
 
@@ -96,44 +135,53 @@ func main() {
 
 					configData, err := config.Load()
 					if err != nil {
-						log.Println("Warning: config file not loaded, proxy will do nothing")
+						slog.Warn("Config file not loaded, keeping the last good config")
+						recordReload(err)
+
+						continue
 					}
 
-					// Update & process new config
-					nanoProxy.applyConfig(configData, timeout)
+					// Update & process new config, invalid config is rejected and logged
+					_ = nanoProxy.applyConfig(configData, timeout)
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
 
-				log.Println("Config watch error:", err)
+				slog.Error("Config watch error", "error", err)
 			}
 		}
 	}()
 
-	log.Println("Watching config file: " + config.GetPath())
+	slog.Info("Watching config file", "path", config.GetPath())
 
 	err = watcher.Add(config.GetPath())
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Try to create config file and watch it
 			// Ignore errors in here it's just a best effort
-			log.Println("Config file not found, creating empty file and watching")
+			slog.Info("Config file not found, creating empty file and watching")
 
 			_ = os.WriteFile(config.GetPath(), []byte(""), 0600)
 			_ = watcher.Add(config.GetPath())
 		} else {
-			log.Fatal(err)
+			fatal("Error watching config file", "error", err)
 		}
 	}
 
 	// Load config from file
 	configData, err := config.Load()
 	if err != nil {
-		log.Println("Warning: config file not loaded, proxy will do nothing")
+		slog.Warn("Config file not loaded, proxy will do nothing")
+	}
+
+	_ = nanoProxy.applyConfig(configData, timeout)
+
+	// Optional separate listener for Prometheus to scrape, keeping metrics away from the proxy port
+	if os.Getenv("METRICS_PORT") != "" {
+		go startMetricsServer(os.Getenv("METRICS_PORT"))
 	}
 
-	nanoProxy.applyConfig(configData, timeout)
 	nanoProxy.startServer(port, timeout, certPath)
 }
@@ -0,0 +1,223 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy Prometheus metrics
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_requests_total",
+		Help: "Total number of requests handled by the proxy",
+	}, []string{"rule", "upstream", "status_class"})
+
+	metricDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nanoproxy_request_duration_seconds",
+		Help:    "Time taken to handle requests, including the time waiting for the upstream",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"rule", "upstream", "status_class"})
+
+	metricResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nanoproxy_response_size_bytes",
+		Help:    "Size of response bodies sent to clients",
+		Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+	}, []string{"rule", "upstream", "status_class"})
+
+	metricInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nanoproxy_requests_in_flight",
+		Help: "Number of requests currently being handled",
+	}, []string{"rule", "upstream"})
+
+	metricUpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_upstream_connection_errors_total",
+		Help: "Total number of requests where the upstream target could not be reached or failed to respond",
+	}, []string{"upstream", "target"})
+
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_upstream_retries_total",
+		Help: "Total number of requests retried, by the reason the previous try failed",
+	}, []string{"upstream", "reason"})
+
+	metricRetriesExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_upstream_retries_budget_exhausted_total",
+		Help: "Total number of retries skipped because the retry budget was used up",
+	}, []string{"upstream"})
+
+	metricBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nanoproxy_circuit_breaker_state",
+		Help: "State of each upstream circuit breaker, 1 for the current state and 0 for the others",
+	}, []string{"upstream", "state"})
+
+	metricBreakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_circuit_breaker_rejected_total",
+		Help: "Total number of requests rejected by a circuit breaker, by reason of open or max-requests",
+	}, []string{"upstream", "reason"})
+
+	metricUpgradesActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nanoproxy_upgraded_connections_active",
+		Help: "Number of upgraded connections currently open, e.g. WebSockets",
+	}, []string{"upstream"})
+
+	metricUpgrades = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_upgraded_connections_total",
+		Help: "Total number of upgraded connections closed, by reason of closed, idle-timeout or max-duration",
+	}, []string{"upstream", "reason"})
+
+	metricUpgradesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_upgraded_connections_rejected_total",
+		Help: "Total number of upgrade requests rejected because the upstream was at its connection limit",
+	}, []string{"upstream"})
+
+	metricUpgradeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nanoproxy_upgraded_connection_duration_seconds",
+		Help:    "How long upgraded connections were open for",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"upstream"})
+
+	metricUpgradeBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_upgraded_connection_bytes_total",
+		Help: "Total bytes sent over upgraded connections, by direction of to_upstream or to_client",
+	}, []string{"upstream", "direction"})
+
+	metricStreamActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nanoproxy_stream_connections_active",
+		Help: "Number of connections currently open through the raw TCP & TLS passthrough listeners",
+	}, []string{"listener"})
+
+	metricStreams = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_stream_connections_total",
+		Help: "Total number of stream listener connections closed, by reason of closed or idle-timeout",
+	}, []string{"listener", "upstream", "reason"})
+
+	metricStreamRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_stream_connections_rejected_total",
+		Help: "Total number of stream listener connections dropped before reaching a target, by reason",
+	}, []string{"listener", "reason"})
+
+	metricStreamBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_stream_bytes_total",
+		Help: "Total bytes sent through the stream listeners, by direction of to_upstream or to_client",
+	}, []string{"listener", "direction"})
+
+	metricReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nanoproxy_config_reloads_total",
+		Help: "Total number of config loads, by result of success or failure",
+	}, []string{"result"})
+)
+
+// Serves /metrics on a separate port, so it can be scraped without going through the proxy routes
+func startMetricsServer(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("Metrics server listening", "port", port)
+
+	if err := server.ListenAndServe(); err != nil {
+		slog.Error("Metrics server error", "error", err)
+	}
+}
+
+// Wraps a ResponseWriter to capture the status code and number of bytes written
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	_ = http.NewResponseController(rr.ResponseWriter).Flush()
+}
+
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rr.ResponseWriter).Hijack()
+}
+
+// Allows http.ResponseController to reach the underlying ResponseWriter
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Status code sent to the client, nothing written means 200 as with net/http
+func (rr *responseRecorder) statusCode() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+
+	return rr.status
+}
+
+// Starts tracking a request in the metrics, call the returned func when the request is finished
+func trackRequest(rule, upstream string, rr *responseRecorder) func() {
+	start := time.Now()
+	inFlight := metricInFlight.WithLabelValues(rule, upstream)
+	inFlight.Inc()
+
+	return func() {
+		inFlight.Dec()
+
+		class := strconv.Itoa(rr.statusCode()/100) + "xx"
+
+		metricRequests.WithLabelValues(rule, upstream, class).Inc()
+		metricDuration.WithLabelValues(rule, upstream, class).Observe(time.Since(start).Seconds())
+		metricResponseSize.WithLabelValues(rule, upstream, class).Observe(float64(rr.bytes))
+	}
+}
+
+// Counts a failure to reach an upstream target, requests cancelled by the client are not counted
+func recordUpstreamError(t *target, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	metricUpstreamErrors.WithLabelValues(t.upstream.name, t.url.Host).Inc()
+}
+
+// Counts a config load, successful or not
+func recordReload(err error) {
+	if err != nil {
+		metricReloads.WithLabelValues("failure").Inc()
+		return
+	}
+
+	metricReloads.WithLabelValues("success").Inc()
+}
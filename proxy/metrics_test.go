@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRequests(t *testing.T) {
+	conf := config.Config{
+		Upstreams: []config.Upstream{{Name: "metrics-up", Targets: []config.Target{newBackend(t, "a")}}},
+		Rules:     []config.Rule{{Name: "metrics-rule", Path: "/metrics-test", Upstream: "metrics-up"}},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	// Metrics are global, so count from where other tests (or runs) left them
+	matched := metricRequests.WithLabelValues("metrics-rule", "metrics-up", "2xx")
+	requests := testutil.ToFloat64(matched)
+	unmatched := testutil.ToFloat64(metricRequests.WithLabelValues("", "", "4xx"))
+
+	for _, path := range []string{"/metrics-test", "/metrics-test", "/nope"} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		np.mainHandler(httptest.NewRecorder(), request)
+	}
+
+	if count := testutil.ToFloat64(matched); count != requests+2 {
+		t.Errorf("Expected 2 requests counted, got %v", count-requests)
+	}
+
+	if count := testutil.ToFloat64(metricRequests.WithLabelValues("", "", "4xx")); count != unmatched+1 {
+		t.Errorf("Expected unmatched request counted, got %v", count-unmatched)
+	}
+
+	if count := testutil.ToFloat64(metricInFlight.WithLabelValues("metrics-rule", "metrics-up")); count != 0 {
+		t.Errorf("Expected no requests in flight, got %v", count)
+	}
+
+	if count := testutil.CollectAndCount(metricResponseSize, "nanoproxy_response_size_bytes"); count == 0 {
+		t.Errorf("Expected response sizes to be recorded")
+	}
+}
+
+func TestMetricsUpstreamError(t *testing.T) {
+	dead := newDeadBackend(t)
+	conf := config.Config{
+		Upstreams: []config.Upstream{{Name: "metrics-down", Targets: []config.Target{dead}}},
+		Rules:     []config.Rule{{Path: "/", Upstream: "metrics-down"}},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	target := dead.Host + ":" + strconv.Itoa(dead.Port)
+	errs := testutil.ToFloat64(metricUpstreamErrors.WithLabelValues("metrics-down", target))
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", response.Code)
+	}
+
+	if count := testutil.ToFloat64(metricUpstreamErrors.WithLabelValues("metrics-down", target)); count != errs+1 {
+		t.Errorf("Expected 1 upstream error, got %v", count-errs)
+	}
+}
+
+func TestMetricsReloadsAndEndpoint(t *testing.T) {
+	failures := testutil.ToFloat64(metricReloads.WithLabelValues("failure"))
+	successes := testutil.ToFloat64(metricReloads.WithLabelValues("success"))
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{})
+	_ = np.applyConfig(&config.Config{Rules: []config.Rule{{Path: "/", Upstream: "missing"}}}, timeout)
+
+	if testutil.ToFloat64(metricReloads.WithLabelValues("success")) != successes+1 {
+		t.Errorf("Expected successful reload to be counted")
+	}
+
+	if testutil.ToFloat64(metricReloads.WithLabelValues("failure")) != failures+1 {
+		t.Errorf("Expected failed reload to be counted")
+	}
+
+	// Metrics reveal target hosts & ports, so they are only on the proxy port when debugging
+	request, _ := http.NewRequest(http.MethodGet, "/.nanoproxy/metrics", nil)
+	response := httptest.NewRecorder()
+	np.createRoutes().ServeHTTP(response, request)
+
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Expected metrics to be disabled without DEBUG, got %d", response.Code)
+	}
+
+	t.Setenv("DEBUG", "1")
+
+	response = httptest.NewRecorder()
+	np.createRoutes().ServeHTTP(response, request)
+
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "nanoproxy_config_reloads_total") {
+		t.Errorf("Expected metrics in Prometheus format, got %d", response.Code)
+	}
+}
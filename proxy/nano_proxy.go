@@ -1,56 +1,54 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"log"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/benc-uk/nanoproxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type NanoProxy struct {
-	proxies map[string]*httputil.ReverseProxy
-	config  *config.Config // Hold a copy of the config
+	state     atomic.Pointer[snapshot] // Live routing state, replaced when config is reloaded
+	reloadMu  sync.Mutex               // Only one config reload at a time
+	accessLog *accessLogger            // Nil when the access log is disabled
+	debug     bool                     // Log every request, decided once at startup
+	idHeader  string                   // Header used for request IDs, X-Request-ID when blank
+	budget    *retryBudget             // Limits retries across all upstreams, nil for no limit
+	streams   streamServers            // Ports open for raw TCP & TLS passthrough listeners
+	shared    sharedState              // Kept across config reloads, e.g. transports, target health & breakers
 }
 
 func (np *NanoProxy) startServer(port string, timeout time.Duration, certPath string) {
-	// Create a server with a timeout and our routes
-	server := &http.Server{
-		Addr:         ":" + port,
-		ReadTimeout:  timeout,
-		WriteTimeout: timeout,
-
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-			MaxVersion: tls.VersionTLS13,
-		},
-
-		// Important! Assign our routes
-		Handler: np.createRoutes(),
-	}
+	server := np.newServer(port, timeout)
 
 	useTLS := false
 
 	// Check for TLS cert & key files if certPath is set
 	if certPath != "" {
-		log.Printf("Checking cert & key files: %s %s", certPath+"/cert.pem", certPath+"/key.pem")
+		slog.Info("Checking cert & key files", "cert", certPath+"/cert.pem", "key", certPath+"/key.pem")
 
 		useTLS = true
 
 		// Check cert & key files exist
 		if _, err := os.Stat(certPath + "/cert.pem"); os.IsNotExist(err) {
-			log.Printf("ERROR! Cert file not found: %s/cert.pem", certPath)
+			slog.Error("Cert file not found", "path", certPath+"/cert.pem")
 
 			useTLS = false
 		}
 
 		if _, err := os.Stat(certPath + "/key.pem"); os.IsNotExist(err) {
-			log.Printf("ERROR! Key file not found: %s/key.pem", certPath)
+			slog.Error("Key file not found", "path", certPath+"/key.pem")
 
 			useTLS = false
 		}
@@ -58,14 +56,14 @@ func (np *NanoProxy) startServer(port string, timeout time.Duration, certPath st
 
 	// Start the server either with TLS or without
 	if useTLS {
-		log.Println("TLS has been enabled, proxy will accept HTTPS traffic on port: " + port)
+		slog.Info("TLS has been enabled, proxy will accept HTTPS traffic", "port", port)
 
 		err := server.ListenAndServeTLS(certPath+"/cert.pem", certPath+"/key.pem")
 		if err != nil {
 			panic(err)
 		}
 	} else {
-		log.Println("TLS is disabled, proxy will accept HTTP traffic on port: " + port)
+		slog.Info("TLS is disabled, proxy will accept HTTP traffic", "port", port)
 
 		err := server.ListenAndServe()
 		if err != nil {
@@ -74,18 +72,63 @@ func (np *NanoProxy) startServer(port string, timeout time.Duration, certPath st
 	}
 }
 
+// Create a server with a timeout and our routes
+func (np *NanoProxy) newServer(port string, timeout time.Duration) *http.Server {
+	return &http.Server{
+		Addr: ":" + port,
+
+		// Only the headers have to arrive in time, request bodies can be streamed for as long as the rule &
+		// upstream timeouts allow, e.g. by gRPC calls or slow uploads
+		ReadHeaderTimeout: timeout,
+
+		// HTTP/2 is accepted over TLS and as cleartext h2c, which is needed for gRPC
+		Protocols: serverProtocols(),
+
+		// There's no write timeout as it would cut off long responses, rules & upstreams have their own timeouts
+
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			MaxVersion: tls.VersionTLS13,
+		},
+
+		// Important! Assign our routes
+		Handler: np.createRoutes(),
+	}
+}
+
+// Protocols accepted by the proxy server, HTTP/1.1 and HTTP/2 with or without TLS
+func serverProtocols() *http.Protocols {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return protocols
+}
+
 func (np *NanoProxy) createRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	// All requests flow through this main handler
 	mux.HandleFunc("/", np.mainHandler)
 
+	// These endpoints reveal the rules, upstreams & internal target URLs, so they are only enabled for debugging
 	if os.Getenv("DEBUG") != "" {
-		log.Println("Debug enabled, exposing /.nanoproxy/config endpoint")
+		slog.Info("Debug enabled, exposing /.nanoproxy/config, /.nanoproxy/upstreams, /.nanoproxy/explain & " +
+			"/.nanoproxy/metrics endpoints")
 
 		mux.HandleFunc("/.nanoproxy/config", func(w http.ResponseWriter, r *http.Request) {
-			_, _ = w.Write([]byte(np.config.Dump()))
+			_, _ = w.Write([]byte(np.current().config.Dump()))
 		})
+
+		// Reports the state of upstreams and the health of their targets
+		mux.HandleFunc("/.nanoproxy/upstreams", np.upstreamsHandler)
+
+		// Dry run showing how a request would be routed, and why other rules were rejected
+		mux.HandleFunc("/.nanoproxy/explain", np.explainHandler)
+
+		// Prometheus metrics, labelled with target host & port. Use METRICS_PORT to serve them away from the proxy port
+		mux.Handle("/.nanoproxy/metrics", promhttp.Handler())
 	}
 
 	// Add health check endpoint, weird name to try to avoid clashes
@@ -96,145 +139,236 @@ func (np *NanoProxy) createRoutes() *http.ServeMux {
 	return mux
 }
 
-// This loads config and creates the reverse proxies
-func (np *NanoProxy) applyConfig(conf *config.Config, timeout time.Duration) {
-	if conf == nil {
-		// Create empty config to panic and nil pointer errors
-		conf = &config.Config{}
+// This loads config, building a new snapshot which is swapped in as one step
+// In-flight requests carry on using the old snapshot until they finish
+// If the config is invalid an error is returned and the last good config stays in use
+func (np *NanoProxy) applyConfig(conf *config.Config, timeout time.Duration) error {
+	np.reloadMu.Lock()
+	defer np.reloadMu.Unlock()
+
+	next, err := newSnapshot(conf, timeout, &np.shared)
+	recordReload(err)
+
+	if err != nil {
+		var validationErrs config.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			for _, e := range validationErrs {
+				slog.Error("Config error", "field", e.Field, "error", e.Message)
+			}
+		} else {
+			slog.Error("Config error", "error", err)
+		}
+
+		if np.state.Load() != nil {
+			slog.Warn("Config is invalid, keeping the last good config")
+		} else {
+			slog.Warn("Config is invalid, proxy will do nothing")
+			next, _ = newSnapshot(nil, timeout, &np.shared)
+			next.startChecks()
+			np.state.Store(next)
+		}
+
+		return err
 	}
 
-	// This is the map of reverse proxies, keyed by upstream name
-	np.proxies = make(map[string]*httputil.ReverseProxy)
+	// Problems which don't stop the config being used, e.g. rules shadowed by other rules
+	for _, w := range next.config.Warnings() {
+		slog.Warn("Config warning", "field", w.Field, "warning", w.Message)
+	}
 
-	// Construct reverse proxies for each upstream
-	// Note the term upstream is used in the config file, but we call them reverse proxies here
-	for _, u := range conf.Upstreams {
-		scheme := u.Scheme
-		if scheme == "" {
-			scheme = "http"
-		}
+	next.startChecks()
+	old := np.state.Swap(next)
 
-		if scheme != "http" && scheme != "https" {
-			log.Fatalf("Invalid scheme found: %s", scheme)
-			continue
-		}
+	// Stop health checks against the old upstreams
+	if old != nil {
+		old.stopChecks()
+	}
 
-		if u.Port == 0 && scheme == "http" {
-			u.Port = 80
-		}
+	// Close idle connections to targets which have gone, or whose settings changed
+	np.shared.transports.retain(next)
 
-		if u.Port == 0 && scheme == "https" {
-			u.Port = 443
-		}
+	// Forget the health of targets which have gone, or whose checks changed
+	np.shared.health.retain(next)
 
-		hostRewrite := true
-		if u.NoHostRewrite {
-			hostRewrite = false
-		}
+	// Drop the circuit breakers of upstreams which have gone, or whose breaker settings changed
+	np.shared.breakers.retain(next)
 
-		revProxy, err := NewReverseProxy(scheme+"://"+u.Host+":"+strconv.Itoa(u.Port), timeout, hostRewrite)
-		if err != nil {
-			log.Fatalf("Error with reverse proxy: %v", err)
-			continue
-		}
+	// Forget the upgraded connection counts of upstreams which have gone, once their connections are closed
+	np.shared.upgrades.retain(next)
 
-		np.proxies[u.Name] = revProxy
-	}
+	// Open & close stream listener ports to match the config
+	np.streams.sync(np, next)
 
-	// Validate & check rules
-	for _, rule := range conf.Rules {
-		if rule.MatchMode != "" && rule.MatchMode != "prefix" && rule.MatchMode != "exact" {
-			log.Printf("Rule error: invalid match mode: %s", rule.MatchMode)
-			continue
-		}
+	return nil
+}
 
-		if rule.Path == "" {
-			log.Printf("Rule error: path is blank, this rule will never match")
-			continue
-		}
-	}
+// Returns the live snapshot, which is safe to use without locking
+func (np *NanoProxy) current() *snapshot {
+	return np.state.Load()
+}
 
-	if len(conf.Rules) <= 0 {
-		log.Printf("Warning: config contains no rules")
-	}
+// Returns the status of all upstreams as JSON
+func (np *NanoProxy) upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	state := np.current()
+	statuses := []upstreamStatus{}
 
-	if len(np.proxies) <= 0 {
-		log.Printf("Warning: config contains no upstreams")
+	for _, u := range state.config.Upstreams {
+		if up := state.upstreams[u.Name]; up != nil {
+			statuses = append(statuses, up.status())
+		}
 	}
 
-	// Store config
-	np.config = conf
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
 }
 
 // This is the main router for all proxied requests
 // The routing logic is here
 func (np *NanoProxy) mainHandler(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DEBUG") != "" {
-		log.Println("Request received: " + r.URL.String())
+	start := time.Now()
+
+	// Continue the trace from the caller, or start a new one
+	r, span := startServerSpan(r)
+
+	// Correlation ID for the request, taken from the caller or generated
+	id := newRequestID(r, np.idHeader)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+	if np.debug {
+		slog.DebugContext(r.Context(), "Request received", "method", r.Method, "host", r.Host, "uri", r.URL.String())
 	}
 
-	// TODO: Optimise this for high volumes of requests and rules
+	// Use the same snapshot for the whole request, even if the config is reloaded
+	state := np.current()
 
-	// Find matching rule, the main routing logic
-	for _, rule := range np.config.Rules {
-		matched := false
+	// Request values used by rule conditions, parsed at most once
+	values := &requestValues{req: r}
 
-		// Strip port from host
-		hostname := r.Host
-		if strings.Contains(hostname, ":") {
-			hostname = strings.Split(hostname, ":")[0]
-		}
+	// Find matching rule & target, the main routing logic
+	d := state.resolve(r, values, false)
 
-		if os.Getenv("DEBUG") != "" {
-			log.Printf("Checking rule host:%s path:%s - against host:%s path:%s",
-				rule.Host, rule.Path, hostname, r.URL.Path)
-		}
+	// Every request is counted in the metrics, including those which don't match a rule
+	rec := &responseRecorder{ResponseWriter: w}
+	w = rec
 
-		// Match on host first, empty host matches all
-		if rule.Host == "" || hostname == rule.Host {
-			// Match path on prefix which is the default MatchMode
-			if (rule.MatchMode == "prefix" || rule.MatchMode == "") && strings.HasPrefix(r.URL.Path, rule.Path) {
-				matched = true
-			}
+	defer trackRequest(d.ruleName(), d.upstreamName(), rec)()
 
-			if rule.MatchMode == "exact" && r.URL.Path == rule.Path {
-				matched = true
-			}
+	defer func() {
+		endServerSpan(span, r, d, rec.statusCode())
+	}()
+
+	// Details of the proxied request, set once it has been sent to the upstream
+	var info *proxyInfo
+
+	if np.accessLog != nil {
+		uri := r.URL.RequestURI()
+
+		defer func() {
+			np.accessLog.write(newAccessEntry(r, uri, rec, d, info, start))
+		}()
+	}
+
+	if d.match == nil {
+		if np.debug {
+			slog.DebugContext(r.Context(), "No matching rule for request", "host", r.Host, "path", r.URL.Path)
 		}
 
-		// Path and/or host was matched to this rule, so proxy the request
-		if matched {
-			if os.Getenv("DEBUG") != "" {
-				log.Printf("Matched rule: %s_%s_%s", rule.Upstream, rule.Host, rule.Path)
-			}
+		// No matching rule found so return 404
+		writeError(w, r, http.StatusNotFound, "No matching rule for host & path")
 
-			// Find proxy named by the rule that was matched
-			proxy := np.proxies[rule.Upstream]
-			if proxy == nil {
-				log.Printf("Rule error: upstream '%s' not found", rule.Upstream)
-				continue
-			}
+		return
+	}
 
-			// Strip path
-			if rule.StripPath {
-				r.URL.Path = strings.Replace(r.URL.Path, rule.Path, "", 1)
-			}
+	rule := d.match.route.rule
+
+	if np.debug {
+		slog.DebugContext(r.Context(), "Matched rule", "rule", d.ruleName(), "upstream", rule.Upstream,
+			"host", rule.Host, "path", rule.Path)
+	}
+
+	if d.target == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "No targets available for upstream")
+
+		return
+	}
+
+	// Strip & rewrite path
+	if d.rewritten {
+		r.URL.Path = d.path
+		r.URL.RawPath = ""
+	}
 
-			//r.Header.Set("Host", "frontend")
+	// Upgrades, e.g. to WebSockets, are counted against the upstream's limit
+	// Rules can opt into long-lived upgrades, then idle & max duration timeouts apply instead of the rule timeout
+	var session *upgradeSession
 
-			// It all comes down to this, proxy the request
-			proxy.ServeHTTP(w, r)
+	if isUpgrade(r) {
+		var err error
+
+		session, err = d.upstream.beginUpgrade(r, rule.Upgrade)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, err.Error())
 
-			// Don't process any more rules
 			return
 		}
+
+		defer session.end()
+
+		r = r.WithContext(context.WithValue(r.Context(), upgradeKey{}, session))
 	}
 
-	if os.Getenv("DEBUG") != "" {
-		log.Printf("No matching rule for request - host:%s path:%s", r.Host, r.URL.Path)
+	// Deadline for the whole request, including waiting for the circuit breaker and any retries
+	if rule.Timeout > 0 && (session == nil || rule.Upgrade == nil) {
+		ctx, cancel := context.WithTimeoutCause(r.Context(), rule.Timeout, errRequestTimeout)
+		defer cancel()
+
+		r = r.WithContext(ctx)
+	}
+
+	// Fail fast when the upstream is failing or too busy, rather than tying up the client
+	probe, err := d.upstream.breaker.acquire(r.Context())
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, errRequestTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+
+		writeError(w, r, status, err.Error())
+
+		return
+	}
+
+	// An upgraded connection is a success once switched, it shouldn't hold on to the breaker while open
+	released := false
+
+	if session != nil {
+		session.onSwitch = func() {
+			released = true
+
+			d.upstream.breaker.release(probe, false)
+		}
+	}
+
+	// It all comes down to this, proxy the request
+	info = d.upstream.serve(w, r, d.target, np.budget)
+
+	if !released {
+		d.upstream.breaker.release(probe, breakerFailure(info))
+	}
+
+	// The reverse proxy writes the switch to the hijacked connection, so the recorder didn't see it
+	if session != nil && session.conn != nil {
+		rec.status = http.StatusSwitchingProtocols
+		rec.bytes = session.conn.toClient.Load()
+	}
+}
+
+// Gets the hostname from the request in lower case, with any port removed
+func requestHostname(r *http.Request) string {
+	hostname := r.Host
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
 	}
 
-	// Fall through, no matching rule found so return 404
-	w.WriteHeader(http.StatusNotFound)
-	_, _ = w.Write([]byte("No matching rule for host & path"))
+	return strings.ToLower(hostname)
 }
@@ -5,7 +5,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -88,7 +91,7 @@ func TestDebugConfDump200(t *testing.T) {
 }
 
 func TestProxyPath200(t *testing.T) {
-	nanoProxy.applyConfig(&simpleConf, timeout)
+	mustApplyConfig(t, nanoProxy, &simpleConf)
 
 	request, _ := http.NewRequest(http.MethodGet, "/api", nil)
 	response := httptest.NewRecorder()
@@ -102,7 +105,7 @@ func TestProxyPath200(t *testing.T) {
 }
 
 func TestProxyPath404(t *testing.T) {
-	nanoProxy.applyConfig(&simpleConf, timeout)
+	mustApplyConfig(t, nanoProxy, &simpleConf)
 
 	request, _ := http.NewRequest(http.MethodGet, "/cake", nil)
 	response := httptest.NewRecorder()
@@ -116,7 +119,7 @@ func TestProxyPath404(t *testing.T) {
 }
 
 func TestProxyPathNoStrip404(t *testing.T) {
-	nanoProxy.applyConfig(&simpleConf, timeout)
+	mustApplyConfig(t, nanoProxy, &simpleConf)
 
 	request, _ := http.NewRequest(http.MethodGet, "/nostrip", nil)
 	response := httptest.NewRecorder()
@@ -130,7 +133,7 @@ func TestProxyPathNoStrip404(t *testing.T) {
 }
 
 func TestProxyPathBadUpstream502(t *testing.T) {
-	nanoProxy.applyConfig(&simpleConf, timeout)
+	mustApplyConfig(t, nanoProxy, &simpleConf)
 
 	request, _ := http.NewRequest(http.MethodGet, "/badupstream", nil)
 	response := httptest.NewRecorder()
@@ -142,3 +145,373 @@ func TestProxyPathBadUpstream502(t *testing.T) {
 		t.Errorf("Expected 502, got %d", response.Code)
 	}
 }
+
+// Returns the address of a test server as a config target
+func serverTarget(server *httptest.Server) config.Target {
+	u, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	return config.Target{Host: u.Hostname(), Port: port}
+}
+
+// Starts a test backend with the given handler, and returns it as a config target
+func newHandlerBackend(t *testing.T, handler http.HandlerFunc) config.Target {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return serverTarget(server)
+}
+
+// Applies the config to the proxy, failing the test if the config is invalid
+func mustApplyConfig(tb testing.TB, np *NanoProxy, conf *config.Config) {
+	tb.Helper()
+
+	if err := np.applyConfig(conf, timeout); err != nil {
+		tb.Fatalf("Unexpected config error: %v", err)
+	}
+}
+
+// Builds a proxy with the config, which is emptied when the test ends to close any listeners & health checks
+func newTestProxy(t *testing.T, conf *config.Config) *NanoProxy {
+	t.Helper()
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, conf)
+	t.Cleanup(func() { _ = np.applyConfig(&config.Config{}, timeout) })
+
+	return np
+}
+
+// Builds a proxy with one upstream and one rule which sends requests to it
+func newSingleUpstreamProxy(t *testing.T, upstream config.Upstream, rule config.Rule) *NanoProxy {
+	t.Helper()
+
+	rule.Upstream = upstream.Name
+
+	return newTestProxy(t, &config.Config{Upstreams: []config.Upstream{upstream}, Rules: []config.Rule{rule}})
+}
+
+// Starts a test backend server which responds with its name, and returns it as a config target
+func newBackend(t *testing.T, name string) config.Target {
+	t.Helper()
+
+	return newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name))
+	})
+}
+
+func TestProxyBalancedTargets(t *testing.T) {
+	conf := config.Config{
+		Rules: []config.Rule{
+			{Path: "/", Upstream: "backends"},
+		},
+		Upstreams: []config.Upstream{
+			{
+				Name:     "backends",
+				Balancer: balanceRoundRobin,
+				Targets:  []config.Target{newBackend(t, "a"), newBackend(t, "b")},
+			},
+		},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	counts := make(map[string]int)
+
+	for i := 0; i < 10; i++ {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		response := httptest.NewRecorder()
+
+		np.mainHandler(response, request)
+
+		if response.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", response.Code)
+		}
+
+		counts[response.Body.String()]++
+	}
+
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("Expected requests split evenly across targets, got %v", counts)
+	}
+}
+
+// Starts a test backend server which responds with the path of the request it received
+func newEchoBackend(t *testing.T) config.Target {
+	t.Helper()
+
+	return newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	})
+}
+
+func TestProxyRegexRewrite(t *testing.T) {
+	conf := config.Config{
+		Rules: []config.Rule{
+			{
+				Path:      `^/legacy/(?P<id>[0-9]+)$`,
+				MatchMode: "regex",
+				Upstream:  "echo",
+				Rewrite:   &config.Rewrite{Path: "/items/${id}"},
+			},
+			{Path: "/static/**", MatchMode: "glob", Upstream: "echo", StripPath: true},
+		},
+		Upstreams: []config.Upstream{
+			{Name: "echo", Targets: []config.Target{newEchoBackend(t)}},
+		},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	tests := map[string]string{
+		"/legacy/42":         "/items/42",
+		"/static/css/a.css":  "/css/a.css",
+		"/legacy/notanumber": "No matching rule for host & path",
+	}
+
+	for path, expected := range tests {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+
+		np.mainHandler(response, request)
+
+		if response.Body.String() != expected {
+			t.Errorf("Expected %s to be proxied as '%s', got '%s'", path, expected, response.Body.String())
+		}
+	}
+}
+
+func TestProxyHeaderAndMethodRouting(t *testing.T) {
+	conf := config.Config{
+		Rules: []config.Rule{
+			{Path: "/", Upstream: "canary", Headers: []config.Match{{Name: "X-Canary", Value: "1"}}},
+			{Path: "/", Upstream: "write", Methods: []string{http.MethodPost, http.MethodPut}},
+			{Path: "/", Upstream: "read"},
+		},
+		Upstreams: []config.Upstream{
+			{Name: "canary", Targets: []config.Target{newBackend(t, "canary")}},
+			{Name: "write", Targets: []config.Target{newBackend(t, "write")}},
+			{Name: "read", Targets: []config.Target{newBackend(t, "read")}},
+		},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	tests := []struct {
+		method   string
+		canary   bool
+		expected string
+	}{
+		{http.MethodGet, false, "read"},
+		{http.MethodPost, false, "write"},
+		{http.MethodPost, true, "canary"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest(test.method, "/", nil)
+		if test.canary {
+			request.Header.Set("X-Canary", "1")
+		}
+
+		response := httptest.NewRecorder()
+		np.mainHandler(response, request)
+
+		if response.Body.String() != test.expected {
+			t.Errorf("Expected %s request to go to %s, got %s", test.method, test.expected, response.Body.String())
+		}
+	}
+}
+
+func TestProxyLongestPrefixWins(t *testing.T) {
+	conf := config.Config{
+		Rules: []config.Rule{
+			{Path: "/", Upstream: "frontend"},
+			{Path: "/api", Upstream: "api"},
+		},
+		Upstreams: []config.Upstream{
+			{Name: "frontend", Targets: []config.Target{newBackend(t, "frontend")}},
+			{Name: "api", Targets: []config.Target{newBackend(t, "api")}},
+		},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	for path, expected := range map[string]string{"/api/users": "api", "/index.html": "frontend"} {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+
+		np.mainHandler(response, request)
+
+		if response.Body.String() != expected {
+			t.Errorf("Expected %s to go to %s, got %s", path, expected, response.Body.String())
+		}
+	}
+}
+
+// Builds a config with the given number of rules, spread across hosts and nested paths
+func benchConfig(rules int) *config.Config {
+	conf := &config.Config{
+		Upstreams: []config.Upstream{{Name: "bench", Host: "localhost"}},
+	}
+
+	for i := 0; i < rules; i++ {
+		conf.Rules = append(conf.Rules, config.Rule{
+			Host:     "host" + strconv.Itoa(i%20) + ".example.com",
+			Path:     "/service" + strconv.Itoa(i) + "/api/v" + strconv.Itoa(i%3),
+			Upstream: "bench",
+		})
+	}
+
+	// A catch-all which every request will also be checked against
+	conf.Rules = append(conf.Rules, config.Rule{Path: "/", Upstream: "bench"})
+
+	return conf
+}
+
+// Shows how route lookup time scales with the number of rules, it should stay roughly flat
+func BenchmarkRouteLookup(b *testing.B) {
+	for _, size := range []int{10, 100, 1000, 10000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			np := &NanoProxy{}
+			mustApplyConfig(b, np, benchConfig(size))
+
+			// Request which matches the last rule added, the worst case for a linear scan
+			last := size - 1
+			request, _ := http.NewRequest(http.MethodGet, "/service"+strconv.Itoa(last)+"/api/v"+strconv.Itoa(last%3)+"/x", nil)
+			request.Host = "host" + strconv.Itoa(last%20) + ".example.com"
+
+			table := np.current().table
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				values := &requestValues{req: request}
+				if table.lookup(requestHostname(request), request.URL.Path, values) == nil {
+					b.Fatal("Expected a match")
+				}
+			}
+		})
+	}
+}
+
+// Reloads config over and over while requests are being served, run with -race to check for data races
+func TestConcurrentReload(t *testing.T) {
+	confs := []*config.Config{}
+
+	for _, name := range []string{"a", "b"} {
+		confs = append(confs, &config.Config{
+			Rules:     []config.Rule{{Path: "/", Upstream: name}},
+			Upstreams: []config.Upstream{{Name: name, Targets: []config.Target{newBackend(t, name)}}},
+		})
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, confs[0])
+
+	done := make(chan struct{})
+	reloaded := make(chan struct{})
+
+	// Keep swapping between the two configs until the requests are finished
+	go func() {
+		defer close(reloaded)
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				np.applyConfig(confs[i%2], timeout)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				request, _ := http.NewRequest(http.MethodGet, "/", nil)
+				response := httptest.NewRecorder()
+
+				np.mainHandler(response, request)
+
+				body := response.Body.String()
+				if response.Code != http.StatusOK || (body != "a" && body != "b") {
+					t.Errorf("Expected 200 from either backend, got %d %s", response.Code, body)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	<-reloaded
+}
+
+// An invalid config on reload must be rejected, leaving the last good config in use
+func TestInvalidReloadKeepsConfig(t *testing.T) {
+	good := &config.Config{
+		Rules:     []config.Rule{{Path: "/", Upstream: "a"}},
+		Upstreams: []config.Upstream{{Name: "a", Targets: []config.Target{newBackend(t, "a")}}},
+	}
+
+	bad := &config.Config{
+		Rules:     []config.Rule{{Path: "/", Upstream: "missing"}},
+		Upstreams: []config.Upstream{{Name: "a", Host: "example.net", Scheme: "gopher"}},
+	}
+
+	np := &NanoProxy{}
+	if err := np.applyConfig(good, timeout); err != nil {
+		t.Fatalf("Unexpected error applying good config: %v", err)
+	}
+
+	if err := np.applyConfig(bad, timeout); err == nil {
+		t.Errorf("Expected error applying bad config, got none")
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusOK || response.Body.String() != "a" {
+		t.Errorf("Expected 200 from last good config, got %d %s", response.Code, response.Body.String())
+	}
+}
+
+// Rules shadowed by other rules, e.g. from two Ingresses for the same host & path, must not block a reload
+func TestShadowedRuleReload(t *testing.T) {
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Rules:     []config.Rule{{Path: "/", Upstream: "a"}},
+		Upstreams: []config.Upstream{{Name: "a", Targets: []config.Target{newBackend(t, "a")}}},
+	})
+
+	mustApplyConfig(t, np, &config.Config{
+		Rules: []config.Rule{{Path: "/", Upstream: "b"}, {Path: "/", Upstream: "a"}},
+		Upstreams: []config.Upstream{
+			{Name: "a", Targets: []config.Target{newBackend(t, "a")}},
+			{Name: "b", Targets: []config.Target{newBackend(t, "b")}},
+		},
+	})
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusOK || response.Body.String() != "b" {
+		t.Errorf("Expected 200 from the first rule, got %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,178 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy passive health checks, ejecting targets which fail real requests
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Defaults for any outlier detection settings not set in the config
+const (
+	outlierDefaultErrors       = 5
+	outlierDefault5xx          = 5
+	outlierDefaultMinRequests  = 10
+	outlierDefaultInterval     = 10 * time.Second
+	outlierDefaultBaseEjection = 30 * time.Second
+	outlierDefaultMaxEjection  = 5 * time.Minute
+	outlierDefaultMaxPercent   = 50
+)
+
+// Tracks the outcome of recent requests to a target
+type outlierState struct {
+	mu                sync.Mutex
+	consecutiveErrors int
+	consecutive5xx    int
+	windowStart       time.Time
+	windowRequests    int
+	windowFailures    int
+	ejections         int // Number of times ejected in a row, used for back-off
+}
+
+// Returns a copy of the outlier detection config with defaults filled in
+func outlierDefaults(od config.OutlierDetection) config.OutlierDetection {
+	if od.ConsecutiveErrors <= 0 {
+		od.ConsecutiveErrors = outlierDefaultErrors
+	}
+
+	if od.Consecutive5xx <= 0 {
+		od.Consecutive5xx = outlierDefault5xx
+	}
+
+	if od.MinRequests <= 0 {
+		od.MinRequests = outlierDefaultMinRequests
+	}
+
+	if od.Interval <= 0 {
+		od.Interval = outlierDefaultInterval
+	}
+
+	if od.BaseEjectionTime <= 0 {
+		od.BaseEjectionTime = outlierDefaultBaseEjection
+	}
+
+	if od.MaxEjectionTime <= 0 {
+		od.MaxEjectionTime = outlierDefaultMaxEjection
+	}
+
+	if od.MaxEjectionPercent <= 0 {
+		od.MaxEjectionPercent = outlierDefaultMaxPercent
+	}
+
+	return od
+}
+
+// Checks if the target is currently ejected
+func (t *target) ejected(now time.Time) bool {
+	return now.UnixNano() < t.ejectedUntil.Load()
+}
+
+// Records the result of a proxied request against the target, which may cause it to be ejected
+// Either err is set for a failure talking to the target, or statusCode for a response from it
+func (u *upstream) recordResult(t *target, statusCode int, err error) {
+	if u.outlier == nil {
+		return
+	}
+
+	// The client going away is not the fault of the target
+	if err != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+
+	od := u.outlier
+	now := time.Now()
+
+	t.outlier.mu.Lock()
+	defer t.outlier.mu.Unlock()
+
+	state := &t.outlier
+
+	if now.Sub(state.windowStart) > od.Interval {
+		state.windowStart = now
+		state.windowRequests = 0
+		state.windowFailures = 0
+	}
+
+	state.windowRequests++
+
+	reason := ""
+
+	switch {
+	case err != nil:
+		state.consecutiveErrors++
+		state.windowFailures++
+
+		if state.consecutiveErrors >= od.ConsecutiveErrors {
+			reason = "consecutive errors"
+		}
+	case statusCode >= 500:
+		state.consecutive5xx++
+		state.consecutiveErrors = 0
+		state.windowFailures++
+
+		if state.consecutive5xx >= od.Consecutive5xx {
+			reason = "consecutive 5xx responses"
+		}
+	default:
+		state.consecutiveErrors = 0
+		state.consecutive5xx = 0
+	}
+
+	if reason == "" && od.FailurePercent > 0 && state.windowRequests >= od.MinRequests &&
+		state.windowFailures*100 >= od.FailurePercent*state.windowRequests {
+		reason = "failure rate"
+	}
+
+	if reason == "" || t.ejected(now) {
+		return
+	}
+
+	// Reset the counters, the target starts afresh when it is put back in rotation
+	state.consecutiveErrors = 0
+	state.consecutive5xx = 0
+	state.windowStart = now
+	state.windowRequests = 0
+	state.windowFailures = 0
+
+	// Don't eject too many targets, better to send traffic somewhere than nowhere
+	ejectedCount := 0
+
+	for _, other := range u.targets {
+		if other.ejected(now) {
+			ejectedCount++
+		}
+	}
+
+	if (ejectedCount+1)*100 > od.MaxEjectionPercent*len(u.targets) {
+		slog.Warn("Outlier detection: target not ejected, too many targets ejected", "upstream", u.name,
+			"target", t.url.String())
+		return
+	}
+
+	// Back-off resets if the target has behaved for a while since it was last ejected
+	if now.Sub(time.Unix(0, t.ejectedUntil.Load())) > od.MaxEjectionTime {
+		state.ejections = 0
+	}
+
+	duration := od.BaseEjectionTime << state.ejections
+	if duration > od.MaxEjectionTime || duration <= 0 {
+		duration = od.MaxEjectionTime
+	}
+
+	if duration < od.MaxEjectionTime {
+		state.ejections++
+	}
+
+	t.ejectedUntil.Store(now.Add(duration).UnixNano())
+
+	slog.Warn("Outlier detection: target ejected", "upstream", u.name, "target", t.url.String(),
+		"duration", duration, "reason", reason)
+}
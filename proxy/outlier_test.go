@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+func TestOutlierEjects5xx(t *testing.T) {
+	failing := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	conf := config.Config{
+		Rules: []config.Rule{
+			{Path: "/", Upstream: "backends"},
+		},
+		Upstreams: []config.Upstream{
+			{
+				Name:             "backends",
+				Targets:          []config.Target{failing, newBackend(t, "well")},
+				OutlierDetection: &config.OutlierDetection{Consecutive5xx: 2},
+			},
+		},
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &conf)
+
+	results := []int{}
+
+	for i := 0; i < 8; i++ {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		response := httptest.NewRecorder()
+
+		np.mainHandler(response, request)
+		results = append(results, response.Code)
+	}
+
+	// Round-robin means the failing target gets requests 1 & 3, after which it's ejected
+	for i, code := range results[4:] {
+		if code != http.StatusOK {
+			t.Errorf("Expected 200 after ejection for request %d, got %d", i+4, code)
+		}
+	}
+
+	if !np.current().upstreams["backends"].targets[0].ejected(time.Now()) {
+		t.Errorf("Expected failing target to be ejected")
+	}
+}
+
+func TestOutlierBackoff(t *testing.T) {
+	up := &upstream{
+		name: "test",
+		outlier: &config.OutlierDetection{
+			ConsecutiveErrors:  1,
+			BaseEjectionTime:   time.Second,
+			MaxEjectionTime:    3 * time.Second,
+			MaxEjectionPercent: 100,
+		},
+	}
+
+	up.targets = []*target{{upstream: up, url: &url.URL{Host: "a"}, targetHealth: &targetHealth{}}}
+	tgt := up.targets[0]
+
+	durations := []time.Duration{}
+
+	for i := 0; i < 3; i++ {
+		before := time.Now()
+		up.recordResult(tgt, 0, errors.New("connection refused"))
+		durations = append(durations, time.Unix(0, tgt.ejectedUntil.Load()).Sub(before).Round(time.Second))
+
+		// Pretend the ejection has just expired
+		tgt.ejectedUntil.Store(time.Now().Add(-time.Millisecond).UnixNano())
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for i := range expected {
+		if durations[i] != expected[i] {
+			t.Errorf("Expected ejection %d to last %v, got %v", i, expected[i], durations[i])
+		}
+	}
+}
+
+func TestOutlierMaxPercent(t *testing.T) {
+	od := outlierDefaults(config.OutlierDetection{ConsecutiveErrors: 1})
+	up := &upstream{name: "test", outlier: &od}
+	up.targets = []*target{{upstream: up, url: &url.URL{Host: "a"}, targetHealth: &targetHealth{}}}
+
+	up.recordResult(up.targets[0], 0, errors.New("connection refused"))
+
+	if up.targets[0].ejected(time.Now()) {
+		t.Errorf("Expected single target not to be ejected with default max percent")
+	}
+}
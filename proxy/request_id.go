@@ -0,0 +1,84 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy request IDs, for correlating proxy & upstream logs
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-ID"
+	maxRequestIDLength     = 200
+)
+
+// The ID of a request and the header it is sent in
+type requestID struct {
+	header string
+	value  string
+}
+
+// Context key used to pass the request ID to the reverse proxy & logging
+type requestIDKey struct{}
+
+// Gets the ID from the incoming request header, or generates a new one
+// IDs which are too long or contain odd characters are replaced, as they end up in logs
+func newRequestID(r *http.Request, header string) *requestID {
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+
+	id := r.Header.Get(header)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+
+	return &requestID{header: header, value: id}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Fetch the request ID from the context, if any
+func requestIDFromContext(ctx context.Context) *requestID {
+	id, _ := ctx.Value(requestIDKey{}).(*requestID)
+	return id
+}
+
+// A slog handler which adds the request ID to log lines, when logged with a request context
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestIDFromContext(ctx); id != nil {
+		rec.AddAttrs(slog.String("requestId", id.value))
+	}
+
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
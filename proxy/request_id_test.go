@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Starts a test backend server which responds with the value of the given header it received
+func newHeaderEchoBackend(t *testing.T, header string) config.Target {
+	t.Helper()
+
+	return newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get(header)))
+	})
+}
+
+func TestRequestIDPassedThrough(t *testing.T) {
+	backend := newHeaderEchoBackend(t, "X-Request-ID")
+	np := newSingleUpstreamProxy(t, config.Upstream{Name: "echo", Targets: []config.Target{backend}},
+		config.Rule{Path: "/echo"})
+
+	request, _ := http.NewRequest(http.MethodGet, "/echo", nil)
+	request.Header.Set("X-Request-ID", "my-id-123")
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Body.String() != "my-id-123" {
+		t.Errorf("Expected upstream to get request ID, got '%s'", response.Body.String())
+	}
+
+	if got := response.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != "my-id-123" {
+		t.Errorf("Expected request ID echoed once on the response, got %v", got)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	backend := newHeaderEchoBackend(t, "X-Request-ID")
+	np := newSingleUpstreamProxy(t, config.Upstream{Name: "echo", Targets: []config.Target{backend}},
+		config.Rule{Path: "/echo"})
+
+	for _, incoming := range []string{"", "bad\nid", strings.Repeat("x", maxRequestIDLength+1)} {
+		request, _ := http.NewRequest(http.MethodGet, "/echo", nil)
+		request.Header.Set("X-Request-ID", incoming)
+		response := httptest.NewRecorder()
+		np.mainHandler(response, request)
+
+		id := response.Header().Get("X-Request-ID")
+		if len(id) != 36 || id == incoming || response.Body.String() != id {
+			t.Errorf("Expected generated request ID sent upstream & echoed, got '%s' and '%s'", id, response.Body.String())
+		}
+	}
+
+	// IDs are also returned when the request doesn't get to an upstream
+	request, _ := http.NewRequest(http.MethodGet, "/nope", nil)
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusNotFound || response.Header().Get("X-Request-ID") == "" {
+		t.Errorf("Expected request ID on 404 response")
+	}
+}
+
+func TestRequestIDCustomHeader(t *testing.T) {
+	backend := newHeaderEchoBackend(t, "X-Correlation-ID")
+	np := newSingleUpstreamProxy(t, config.Upstream{Name: "echo", Targets: []config.Target{backend}},
+		config.Rule{Path: "/echo"})
+	np.idHeader = "X-Correlation-ID"
+
+	request, _ := http.NewRequest(http.MethodGet, "/echo", nil)
+	request.Header.Set("X-Correlation-ID", "corr-1")
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Body.String() != "corr-1" || response.Header().Get("X-Correlation-ID") != "corr-1" {
+		t.Errorf("Expected custom request ID header to be used, got '%s'", response.Body.String())
+	}
+}
+
+func TestRequestIDLogHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(requestIDHandler{slog.NewTextHandler(buf, nil)}).With("app", "test")
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, &requestID{value: "log-id-1"})
+	logger.InfoContext(ctx, "hello")
+	logger.Info("no context")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !strings.Contains(lines[0], "requestId=log-id-1") || strings.Contains(lines[1], "requestId") {
+		t.Errorf("Expected request ID only on the line logged with context, got %v", lines)
+	}
+}
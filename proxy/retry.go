@@ -0,0 +1,309 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy retries, failed requests are tried again on another target
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Defaults for any retry settings not set in the config
+const (
+	retryDefaultAttempts   = 2
+	retryDefaultBackOff    = 25 * time.Millisecond
+	retryDefaultMaxBackOff = 250 * time.Millisecond
+)
+
+const (
+	retryBudgetDefaultPercent = 20
+	retryBudgetDefaultMin     = 10
+	retryBudgetWindow         = 10 * time.Second
+
+	// Request bodies bigger than this are not buffered, so those requests are never retried
+	retryMaxBodySize = 64 * 1024
+)
+
+// Methods which are safe to send more than once, the default for retries
+var idempotentMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace,
+}
+
+var (
+	// Returned from ModifyResponse to drop a response which is going to be retried
+	errRetry = errors.New("response will be retried")
+
+	// Cause of the context being cancelled when a try takes too long
+	errPerTryTimeout = errors.New("per-try timeout")
+)
+
+// Returns a copy of the retry policy with defaults filled in
+func retryDefaults(rp config.RetryPolicy) config.RetryPolicy {
+	if rp.Attempts <= 0 {
+		rp.Attempts = retryDefaultAttempts
+	}
+
+	if len(rp.RetryOn) == 0 {
+		rp.RetryOn = []string{
+			config.RetryConnectFailure, config.RetryTimeout, config.Retry502, config.Retry503, config.Retry504,
+		}
+	}
+
+	methods := idempotentMethods
+	if len(rp.Methods) > 0 {
+		methods = rp.Methods
+	}
+
+	rp.Methods = make([]string, 0, len(methods))
+	for _, m := range methods {
+		rp.Methods = append(rp.Methods, strings.ToUpper(m))
+	}
+
+	if rp.BackOff <= 0 {
+		rp.BackOff = retryDefaultBackOff
+	}
+
+	if rp.MaxBackOff <= 0 {
+		rp.MaxBackOff = max(retryDefaultMaxBackOff, rp.BackOff)
+	}
+
+	return rp
+}
+
+// Tracks the tries of a single request to an upstream with a retry policy
+type retryState struct {
+	policy   *config.RetryPolicy
+	upstream *upstream
+	budget   *retryBudget
+	ctx      context.Context // Context of the client request, retries stop if it's cancelled
+	enabled  bool            // The method is allowed and the body can be sent again
+	body     []byte          // Buffered request body, sent with each try
+	attempt  int             // Current try, starting at 1
+	tried    []*target
+	next     *target // Set when the current try has failed and will be retried on this target
+}
+
+// Sets up retries for a request, returns nil when the upstream has no retry policy
+func (u *upstream) newRetryState(r *http.Request, budget *retryBudget) *retryState {
+	if u.retries == nil {
+		return nil
+	}
+
+	rs := &retryState{
+		policy:   u.retries,
+		upstream: u,
+		budget:   budget,
+		ctx:      r.Context(),
+		enabled:  u.retries.Attempts > 1 && slices.Contains(u.retries.Methods, r.Method),
+	}
+
+	// The body has to be kept so it can be sent again, unless it's too big or of unknown size
+	if rs.enabled && r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if r.ContentLength < 0 || r.ContentLength > retryMaxBodySize {
+			rs.enabled = false
+			return rs
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+		if err != nil {
+			// Let the first try fail with the same error, by sending on what was read
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			rs.enabled = false
+
+			return rs
+		}
+
+		rs.body = body
+	}
+
+	return rs
+}
+
+// Prepares the request for the next try to the given target
+func (rs *retryState) begin(r *http.Request, t *target) {
+	rs.attempt++
+	rs.tried = append(rs.tried, t)
+	rs.next = nil
+
+	if rs.body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(rs.body))
+	}
+}
+
+// Decides if the current try should be retried after failing with the status code or error
+// The target for the next try is picked here, so the failure is only swallowed if a retry will happen
+func (rs *retryState) shouldRetry(status int, err error) bool {
+	if rs == nil || !rs.enabled || rs.attempt >= rs.policy.Attempts || rs.ctx.Err() != nil {
+		return false
+	}
+
+	reason := retryReason(status, err)
+	if reason == "" || !slices.Contains(rs.policy.RetryOn, reason) {
+		return false
+	}
+
+	next := rs.upstream.pickExcluding(rs.tried)
+	if next == nil {
+		return false
+	}
+
+	if !rs.budget.allow() {
+		slog.WarnContext(rs.ctx, "Retry budget exhausted, not retrying", "upstream", rs.upstream.name)
+		metricRetriesExhausted.WithLabelValues(rs.upstream.name).Inc()
+
+		return false
+	}
+
+	slog.InfoContext(rs.ctx, "Retrying request", "upstream", rs.upstream.name, "attempt", rs.attempt+1,
+		"target", next.url.Host, "reason", reason)
+	metricRetries.WithLabelValues(rs.upstream.name, reason).Inc()
+
+	rs.next = next
+
+	return true
+}
+
+// Waits before the next try, with exponential back-off and jitter so retries don't arrive in step
+func (rs *retryState) wait() {
+	delay := rs.policy.BackOff << (rs.attempt - 1)
+	if delay > rs.policy.MaxBackOff || delay <= 0 {
+		delay = rs.policy.MaxBackOff
+	}
+
+	// Somewhere between half and all of the delay
+	delay = delay/2 + rand.N(delay/2+1) //nolint:gosec
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-rs.ctx.Done():
+	}
+}
+
+// Name of the retryable failure for a status code or error, as used in the retry policy, blank if not retryable
+func retryReason(status int, err error) string {
+	if err != nil {
+		// Failing to connect means the request was never sent, so it's always safe to retry
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return config.RetryConnectFailure
+		}
+
+		if isTimeout(err) {
+			return config.RetryTimeout
+		}
+
+		return ""
+	}
+
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(status)
+	}
+
+	return ""
+}
+
+// Picks a target which hasn't been tried yet, falling back to any available target
+func (u *upstream) pickExcluding(tried []*target) *target {
+	available := u.available()
+
+	untried := make([]*target, 0, len(available))
+
+	for _, t := range available {
+		if !slices.Contains(tried, t) {
+			untried = append(untried, t)
+		}
+	}
+
+	if len(untried) > 0 {
+		return u.balancer.pick(untried)
+	}
+
+	return u.balancer.pick(available)
+}
+
+// Limits retries across all upstreams to a percentage of requests, so a failing upstream doesn't
+// lead to a storm of retries. A minimum number of retries is always allowed, for when traffic is low
+type retryBudget struct {
+	mu         sync.Mutex
+	percent    int
+	minRetries int
+	start      time.Time // Start of the current window
+	requests   int
+	retries    int
+}
+
+// Builds the retry budget from the RETRY_BUDGET_PERCENT & RETRY_BUDGET_MIN env vars
+func newRetryBudgetFromEnv() (*retryBudget, error) {
+	percent, err := envInt("RETRY_BUDGET_PERCENT", retryBudgetDefaultPercent)
+	if err != nil {
+		return nil, err
+	}
+
+	minRetries, err := envInt("RETRY_BUDGET_MIN", retryBudgetDefaultMin)
+	if err != nil {
+		return nil, err
+	}
+
+	return &retryBudget{percent: percent, minRetries: minRetries}, nil
+}
+
+// Starts a new window when the current one is over, must be called with the lock held
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.start) > retryBudgetWindow {
+		b.start = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// Counts a request sent to an upstream, a nil budget doesn't count anything
+func (b *retryBudget) request() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(time.Now())
+	b.requests++
+}
+
+// Checks if there is budget for a retry and uses it, a nil budget always allows retries
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.roll(time.Now())
+
+	if b.retries >= b.minRetries && b.retries*100 >= b.percent*b.requests {
+		return false
+	}
+
+	b.retries++
+
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Returns a target where nothing is listening, so connections are refused
+func newDeadBackend(t *testing.T) config.Target {
+	t.Helper()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	return serverTarget(server)
+}
+
+func TestRetryConnectFailure(t *testing.T) {
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{newDeadBackend(t), newBackend(t, "alive")},
+		Retries: &config.RetryPolicy{},
+	}, config.Rule{Path: "/"})
+
+	for i := 0; i < 4; i++ {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		response := httptest.NewRecorder()
+		np.mainHandler(response, request)
+
+		if response.Code != http.StatusOK || response.Body.String() != "alive" {
+			t.Errorf("Expected request %d to be retried on the other target, got %d", i, response.Code)
+		}
+	}
+
+	// Without a retry policy the dead target gives a 502
+	np = newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{newDeadBackend(t), newBackend(t, "alive")},
+	}, config.Rule{Path: "/"})
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 without retries, got %d", response.Code)
+	}
+}
+
+func TestRetryStatus(t *testing.T) {
+	var hits atomic.Int32
+
+	flaky := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if hits.Add(1)%2 == 1 {
+			w.Header().Set("X-Flaky", "yes")
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		_, _ = w.Write(body)
+	})
+
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{flaky},
+		Retries: &config.RetryPolicy{Attempts: 3},
+	}, config.Rule{Path: "/"})
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusOK || hits.Load() != 2 || response.Header().Get("X-Flaky") != "" {
+		t.Errorf("Expected 503 to be retried, got %d after %d tries", response.Code, hits.Load())
+	}
+
+	// POST isn't retried by default
+	hits.Store(0)
+
+	request, _ = http.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	response = httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusServiceUnavailable || hits.Load() != 1 {
+		t.Errorf("Expected POST not to be retried, got %d after %d tries", response.Code, hits.Load())
+	}
+
+	// Unless the policy allows it, then the body is sent again
+	np = newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{flaky},
+		Retries: &config.RetryPolicy{Methods: []string{"post"}},
+	}, config.Rule{Path: "/"})
+	hits.Store(0)
+
+	request, _ = http.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	response = httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusOK || response.Body.String() != "hello" {
+		t.Errorf("Expected POST to be retried with the body, got %d '%s'", response.Code, response.Body.String())
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	slow := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{slow},
+		Retries: &config.RetryPolicy{PerTryTimeout: 50 * time.Millisecond},
+	}, config.Rule{Path: "/"})
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+	start := time.Now()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusGatewayTimeout || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected 504 after the tries timed out, got %d in %v", response.Code, time.Since(start))
+	}
+
+	// With another target the retry succeeds
+	np = newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{slow, newBackend(t, "fast")},
+		Retries: &config.RetryPolicy{PerTryTimeout: 50 * time.Millisecond},
+	}, config.Rule{Path: "/"})
+
+	for i := 0; i < 2; i++ {
+		request, _ = http.NewRequest(http.MethodGet, "/", nil)
+		response = httptest.NewRecorder()
+		np.mainHandler(response, request)
+
+		if response.Code != http.StatusOK || response.Body.String() != "fast" {
+			t.Errorf("Expected timed out try to be retried on the other target, got %d", response.Code)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:    "retried",
+		Targets: []config.Target{newDeadBackend(t)},
+		Retries: &config.RetryPolicy{Attempts: 5},
+	}, config.Rule{Path: "/"})
+	np.budget = &retryBudget{percent: 20, minRetries: 1}
+
+	for i := 0; i < 9; i++ {
+		np.budget.request()
+	}
+
+	// 9 requests so far, plus this one, allows 2 retries
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	response := httptest.NewRecorder()
+	np.mainHandler(response, request)
+
+	if response.Code != http.StatusBadGateway || np.budget.retries != 2 {
+		t.Errorf("Expected retries to stop when the budget is used, got %d retries", np.budget.retries)
+	}
+
+	// The minimum applies when there's not much traffic
+	budget := &retryBudget{percent: 10, minRetries: 3}
+	allowed := 0
+
+	for i := 0; i < 5; i++ {
+		if budget.allow() {
+			allowed++
+		}
+	}
+
+	if allowed != 3 {
+		t.Errorf("Expected minimum of 3 retries allowed, got %d", allowed)
+	}
+}
@@ -6,12 +6,11 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
-	"net"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"time"
 )
@@ -20,50 +19,31 @@ const (
 	proxyName = "Nanoproxy"
 )
 
-var hostname string
-
-// Builds a httputil.ReverseProxy based on a target URL and timeout
-func NewReverseProxy(targetURL string, timeout time.Duration, hostRewrite bool) (*httputil.ReverseProxy, error) {
-	log.Printf("Creating upstream: %v\n", targetURL)
-
-	incomingURL, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, err
-	}
+// Hostname of where we are running
+var hostname = getHostname()
 
+// Builds a httputil.ReverseProxy, requests are sent to the target held in the request context
+// using the transport of that target
+func NewReverseProxy(hostRewrite bool) (*httputil.ReverseProxy, error) {
 	// This httputil.ReverseProxy is doing a lot of the heavy lifting
-	proxy := httputil.NewSingleHostReverseProxy(incomingURL)
-
-	// Check if we should skip TLS verification
-	skipTLSVerify := false
-
-	skipTLSVerifyEnv := os.Getenv("TLS_SKIP_VERIFY")
-	if skipTLSVerifyEnv != "" {
-		skipTLSVerify = true
-	}
-
-	// create Transport with timeout
-	proxy.Transport = &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout: timeout,
-		}).DialContext,
-
-		//nolint:gosec
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipTLSVerify},
-	}
+	proxy := &httputil.ReverseProxy{}
+	proxy.Transport = targetTransport{}
 
 	// Hook in our own request/response modifiers
-	proxy.Director = nil
-	proxy.Rewrite = modifyRequest(incomingURL, hostRewrite)
+	proxy.Rewrite = modifyRequest(hostRewrite)
 	proxy.ModifyResponse = modifyResponse()
+	proxy.ErrorHandler = handleError()
+
+	return proxy, nil
+}
 
-	// get hostname of where we are running
-	hostname, err = os.Hostname()
+func getHostname() string {
+	name, err := os.Hostname()
 	if err != nil {
-		hostname = "unknown"
+		return "unknown"
 	}
 
-	return proxy, nil
+	return name
 }
 
 // This isn't really doing a lot but could be used to modify the response
@@ -73,18 +53,87 @@ func modifyResponse() func(*http.Response) error {
 		resp.Header.Set("X-Proxy", proxyName+"/"+version)
 		resp.Header.Set("X-Proxy-Instance", hostname)
 
+		// Echo the request ID back to the client, replacing any the upstream sent
+		if id := requestIDFromContext(resp.Request.Context()); id != nil {
+			resp.Header.Set(id.header, id.value)
+		}
+
+		// Track the result for passive health checking
+		if info := proxyInfoFromContext(resp.Request.Context()); info != nil {
+			// The response arrived just as the try timed out, so treat it as a timeout
+			if info.timer != nil && !info.timer.Stop() {
+				return info.timeoutErr
+			}
+
+			info.latency = time.Since(info.sent)
+			info.status = resp.StatusCode
+			info.target.upstream.recordResult(info.target, resp.StatusCode, nil)
+
+			// Track the upgraded connection, and close it when idle or open too long
+			session := upgradeFromContext(resp.Request.Context())
+			if session != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+				session.switched(resp)
+			}
+
+			// Drop the response and try again, nothing has been sent to the client yet
+			if info.retry.shouldRetry(resp.StatusCode, nil) {
+				return errRetry
+			}
+		}
+
 		return nil
 	}
 }
 
+// Called when the upstream could not be reached or failed to respond
+func handleError() func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		// The response was dropped by modifyResponse, the request is being retried
+		if errors.Is(err, errRetry) {
+			return
+		}
+
+		// Report which of our timeouts cancelled the request, rather than the error from the transport
+		if cause := context.Cause(r.Context()); cause != nil && !errors.Is(cause, context.Canceled) {
+			err = cause
+		}
+
+		slog.WarnContext(r.Context(), "Upstream error", "error", err)
+
+		// Track the failure for passive health checking & metrics
+		if info := proxyInfoFromContext(r.Context()); info != nil {
+			info.latency = time.Since(info.sent)
+			info.err = err
+			info.target.upstream.recordResult(info.target, 0, err)
+			recordUpstreamError(info.target, err)
+
+			if info.retry.shouldRetry(0, err) {
+				return
+			}
+		}
+
+		writeError(w, r, errorStatus(err), "")
+	}
+}
+
 // Setup the request to be sent to the upstream server
-func modifyRequest(url *url.URL, hostRewrite bool) func(*httputil.ProxyRequest) {
+func modifyRequest(hostRewrite bool) func(*httputil.ProxyRequest) {
 	return func(proxyReq *httputil.ProxyRequest) {
 		// Setting X-Forwarded-For and X-Forwarded-Host headers seems polite
 		proxyReq.SetXForwarded()
 
-		// Set the URL to the upstream server
-		proxyReq.SetURL(url)
+		// Set the URL to the upstream target picked for this request
+		if t := targetFromContext(proxyReq.In.Context()); t != nil {
+			proxyReq.SetURL(t.url)
+		}
+
+		// Forward the request ID, which may have been generated here
+		if id := requestIDFromContext(proxyReq.In.Context()); id != nil {
+			proxyReq.Out.Header.Set(id.header, id.value)
+		}
+
+		// Carry on the trace to the upstream, with the client span as the parent
+		injectTraceContext(proxyReq.Out)
 
 		// IMPORTANT: Preserve the original host header
 		if hostRewrite {
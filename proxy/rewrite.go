@@ -0,0 +1,65 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy path rewriting, applied to requests before they go to the upstream
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+)
+
+// Returns the path to send to the upstream, after stripping and rewriting as set in the rule
+// The steps are applied in order: strip, replace whole path, replace prefix, regex substitution, add base path
+func (m *routeMatch) rewrite() string {
+	rule := m.route.rule
+	path := m.path
+
+	if rule.StripPath {
+		path = m.strip()
+	}
+
+	if rw := rule.Rewrite; rw != nil {
+		if rw.Path != "" {
+			path = m.expand(rw.Path)
+		}
+
+		if rw.Prefix != "" {
+			path = m.expand(rw.Prefix) + m.strip()
+		}
+
+		if m.route.rewriteRegex != nil {
+			path = m.route.rewriteRegex.ReplaceAllString(path, rw.Replacement)
+		}
+
+		if rw.BasePath != "" {
+			path = strings.TrimSuffix(rw.BasePath, "/") + ensureSlash(path)
+		}
+	}
+
+	return ensureSlash(path)
+}
+
+// Returns the path with the matched part removed
+// Glob patterns match the whole path, so only the literal part before the first wildcard is removed
+func (m *routeMatch) strip() string {
+	if m.route.mode == matchGlob {
+		return m.path[len(m.route.globPrefix):]
+	}
+
+	if m.captures != nil {
+		return m.path[:m.captures[0]] + m.path[m.captures[1]:]
+	}
+
+	// Prefix & exact matches are always at the start of the path
+	return m.path[len(m.route.rule.Path):]
+}
+
+// Paths sent to the upstream should always start with a slash
+func ensureSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+
+	return path
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		rule     config.Rule
+		path     string
+		expected string
+	}{
+		// Strip only removes the matched prefix, not a later occurrence
+		{config.Rule{Path: "/api", StripPath: true}, "/api/users/api", "/users/api"},
+		{config.Rule{Path: "/api", StripPath: true}, "/api", "/"},
+		{config.Rule{Path: "/api", MatchMode: matchExact, StripPath: true}, "/api", "/"},
+		{config.Rule{Path: "/api", StripPath: true}, "/apix", "/x"},
+		{config.Rule{Path: "/api"}, "/api/users", "/api/users"},
+
+		// Glob rules only strip the literal part of the pattern before the first wildcard
+		{config.Rule{Path: "/static/**", MatchMode: matchGlob, StripPath: true}, "/static/css/a.css", "/css/a.css"},
+		{config.Rule{Path: "/img/*.png", MatchMode: matchGlob, StripPath: true}, "/img/logo.png", "/logo.png"},
+		{config.Rule{Path: "/**", MatchMode: matchGlob, StripPath: true}, "/a/b", "/a/b"},
+
+		// Mount a service expecting /v2/... under /orders/...
+		{config.Rule{Path: "/orders", Rewrite: &config.Rewrite{Prefix: "/v2"}}, "/orders/123", "/v2/123"},
+		{config.Rule{Path: "/orders", StripPath: true, Rewrite: &config.Rewrite{BasePath: "/v2/"}}, "/orders/1", "/v2/1"},
+		{config.Rule{Path: "/", Rewrite: &config.Rewrite{BasePath: "/app"}}, "/index.html", "/app/index.html"},
+
+		// Regex substitution using captures from the rewrite regex
+		{
+			config.Rule{Path: "/", Rewrite: &config.Rewrite{Regex: `^/user/(\w+)/(\w+)$`, Replacement: "/$2/$1"}},
+			"/user/bob/photos", "/photos/bob",
+		},
+
+		// Whole path and prefix replacements can use captures from the rule match
+		{
+			config.Rule{Path: `^/v(\d+)/`, MatchMode: matchRegex, Rewrite: &config.Rewrite{Prefix: "/api/version-$1/"}},
+			"/v3/orders", "/api/version-3/orders",
+		},
+		{
+			config.Rule{Path: "/files/*", MatchMode: matchGlob, Rewrite: &config.Rewrite{Path: "/download/$1"}},
+			"/files/report.pdf", "/download/report.pdf",
+		},
+	}
+
+	for _, test := range tests {
+		rt, err := compileRoute(test.rule)
+		if err != nil {
+			t.Fatalf("Unexpected error compiling rule %+v: %v", test.rule, err)
+		}
+
+		m := rt.matchPath(test.path)
+		if m == nil {
+			t.Fatalf("Expected rule %+v to match %s", test.rule, test.path)
+		}
+
+		if got := m.rewrite(); got != test.expected {
+			t.Errorf("Expected %s to be rewritten to %s, got %s", test.path, test.expected, got)
+		}
+	}
+}
+
+func TestRewriteInvalidRegex(t *testing.T) {
+	_, err := compileRoute(config.Rule{Path: "/", Rewrite: &config.Rewrite{Regex: "(oops"}})
+	if err == nil {
+		t.Errorf("Expected error for invalid rewrite regex")
+	}
+}
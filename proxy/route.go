@@ -0,0 +1,210 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy routes, rules compiled ready for matching against requests
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Names of the path & host match modes, as used in the config file
+const (
+	matchPrefix   = config.MatchPrefix
+	matchExact    = config.MatchExact
+	matchRegex    = config.MatchRegex
+	matchGlob     = config.MatchGlob
+	matchWildcard = "wildcard" // Only used internally, detected from the host
+)
+
+// A route is a rule which has been compiled, ready to match requests against
+type route struct {
+	rule         config.Rule
+	name         string // Name of the rule used in metrics, the host & path when not set
+	mode         string
+	pattern      *regexp.Regexp // Only set for regex & glob match modes
+	globPrefix   string         // Literal start of a glob pattern, before the first wildcard
+	host         string         // Lower case host, or the suffix (e.g. '.example.com') for wildcard hosts
+	hostMode     string
+	hostPattern  *regexp.Regexp // Only set for the regex host match mode
+	rewriteRegex *regexp.Regexp // Only set when the rule has a rewrite regex
+	methods      []string
+	conditions   []condition
+	index        int // Position of the rule in the config file
+	rank         int // Position in order of precedence, set when the route table is built
+}
+
+// The result of a request matching a route
+type routeMatch struct {
+	route    *route
+	path     string // The request path that was matched
+	captures []int  // Submatch indexes into path, only for regex & glob routes
+}
+
+// Compiles a rule into a route, regex & glob patterns are compiled here once at config load
+// gRPC rules become a path match plus a condition on the content type
+func compileRoute(rule config.Rule) (*route, error) {
+	rule = rule.WithGRPC()
+
+	if rule.Upgrade != nil {
+		up := upgradeDefaults(*rule.Upgrade)
+		rule.Upgrade = &up
+	}
+
+	rt := &route{rule: rule, mode: rule.MatchMode, name: rule.Name}
+	if rt.name == "" {
+		rt.name = rule.Host + rule.Path
+	}
+
+	if rt.mode == "" {
+		rt.mode = matchPrefix
+	}
+
+	var err error
+
+	switch rt.mode {
+	case matchPrefix, matchExact:
+	case matchRegex:
+		rt.pattern, err = regexp.Compile(rule.Path)
+	case matchGlob:
+		rt.pattern, err = regexp.Compile(globToRegex(rule.Path))
+		rt.globPrefix = rule.Path[:strings.IndexAny(rule.Path+"*", "*?")]
+	default:
+		return nil, fmt.Errorf("invalid match mode: %s", rule.MatchMode)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s path '%s': %v", rt.mode, rule.Path, err)
+	}
+
+	if err := rt.compileHost(); err != nil {
+		return nil, err
+	}
+
+	rt.methods = compileMethods(rule.Methods)
+
+	rt.conditions, err = compileConditions(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if rule.Rewrite != nil && rule.Rewrite.Regex != "" {
+		rt.rewriteRegex, err = regexp.Compile(rule.Rewrite.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex '%s': %v", rule.Rewrite.Regex, err)
+		}
+	}
+
+	return rt, nil
+}
+
+// Works out how the host of the rule is matched, wildcard hosts are detected from a leading '*.'
+func (rt *route) compileHost() error {
+	rt.host = strings.ToLower(rt.rule.Host)
+
+	switch rt.rule.HostMatchMode {
+	case "":
+		rt.hostMode = matchExact
+
+		if strings.HasPrefix(rt.host, "*.") {
+			rt.hostMode = matchWildcard
+			rt.host = rt.host[1:]
+		}
+	case matchRegex:
+		if rt.rule.Host == "" {
+			return fmt.Errorf("regex host match mode needs a host pattern")
+		}
+
+		pattern, err := regexp.Compile("(?i)" + rt.rule.Host)
+		if err != nil {
+			return fmt.Errorf("invalid host regex '%s': %v", rt.rule.Host, err)
+		}
+
+		rt.hostMode = matchRegex
+		rt.hostPattern = pattern
+	default:
+		return fmt.Errorf("invalid host match mode: %s", rt.rule.HostMatchMode)
+	}
+
+	return nil
+}
+
+// Matches the hostname against the route, an empty host in the rule matches all
+// Wildcards only match a single label, so '*.example.com' does not match 'a.b.example.com' or 'example.com'
+func (rt *route) matchHost(hostname string) bool {
+	switch rt.hostMode {
+	case matchWildcard:
+		label, found := strings.CutSuffix(hostname, rt.host)
+		return found && label != "" && !strings.Contains(label, ".")
+	case matchRegex:
+		return rt.hostPattern.MatchString(hostname)
+	}
+
+	return rt.host == "" || hostname == rt.host
+}
+
+// Matches the path against the route, returning nil if there is no match
+func (rt *route) matchPath(path string) *routeMatch {
+	switch rt.mode {
+	case matchPrefix:
+		if strings.HasPrefix(path, rt.rule.Path) {
+			return &routeMatch{route: rt, path: path}
+		}
+	case matchExact:
+		if path == rt.rule.Path {
+			return &routeMatch{route: rt, path: path}
+		}
+	case matchRegex, matchGlob:
+		if captures := rt.pattern.FindStringSubmatchIndex(path); captures != nil {
+			return &routeMatch{route: rt, path: path, captures: captures}
+		}
+	}
+
+	return nil
+}
+
+// Expands $1 or ${name} references to captures from the matched path, see regexp.Expand
+func (m *routeMatch) expand(template string) string {
+	if m.captures == nil {
+		return template
+	}
+
+	return string(m.route.pattern.ExpandString(nil, template, m.path, m.captures))
+}
+
+// Converts a glob pattern into an anchored regex, each wildcard becomes a numbered capture group
+// A '*' matches within a single path segment, '**' matches across segments and '?' matches one character
+func globToRegex(glob string) string {
+	var sb strings.Builder
+
+	sb.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString("(.*)")
+			i++
+		case glob[i] == '*':
+			sb.WriteString("([^/]*)")
+		case glob[i] == '?':
+			sb.WriteString("([^/])")
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	sb.WriteString("$")
+
+	return sb.String()
+}
+
+// Compares two routes for ordering, routes which sort first are checked first
+// See config.ComparePrecedence for the order, anything else is left in the order of the config file
+func compareRoutes(a, b *route) int {
+	return config.ComparePrecedence(a.rule, b.rule)
+}
@@ -0,0 +1,223 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy routing table, compiled from the rules for fast request lookups
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+)
+
+// A routeTable is an immutable index of routes, built once when the config is loaded
+// Routes are grouped by host, then exact paths are held in a map and prefix paths in a radix trie
+// This means a lookup only looks at the few routes which could possibly match
+type routeTable struct {
+	exactHosts    map[string]*hostRoutes // Keyed by host
+	wildcardHosts map[string]*hostRoutes // Keyed by suffix, e.g. '.example.com'
+	regexHosts    []*route               // Rare, so these are simply scanned
+	anyHost       *hostRoutes
+}
+
+// The routes for one host
+type hostRoutes struct {
+	exact    map[string][]*route
+	prefix   *radixNode
+	patterns []*route // Regex & glob paths
+}
+
+// A node in a radix trie of path prefixes, each node holds the routes with a path ending at that node
+type radixNode struct {
+	prefix   string
+	children []*radixNode
+	routes   []*route
+}
+
+// Maximum number of candidate routes held on the stack during a lookup, more will spill to the heap
+const maxCandidates = 16
+
+// Builds a table from routes, which must already be sorted in order of precedence
+func newRouteTable(routes []*route) *routeTable {
+	t := &routeTable{
+		exactHosts:    make(map[string]*hostRoutes),
+		wildcardHosts: make(map[string]*hostRoutes),
+		anyHost:       newHostRoutes(),
+	}
+
+	for i, rt := range routes {
+		rt.rank = i
+
+		var hr *hostRoutes
+
+		switch {
+		case rt.hostMode == matchRegex:
+			t.regexHosts = append(t.regexHosts, rt)
+			continue
+		case rt.hostMode == matchWildcard:
+			hr = t.wildcardHosts[rt.host]
+			if hr == nil {
+				hr = newHostRoutes()
+				t.wildcardHosts[rt.host] = hr
+			}
+		case rt.host != "":
+			hr = t.exactHosts[rt.host]
+			if hr == nil {
+				hr = newHostRoutes()
+				t.exactHosts[rt.host] = hr
+			}
+		default:
+			hr = t.anyHost
+		}
+
+		hr.add(rt)
+	}
+
+	return t
+}
+
+func newHostRoutes() *hostRoutes {
+	return &hostRoutes{
+		exact:  make(map[string][]*route),
+		prefix: &radixNode{},
+	}
+}
+
+func (hr *hostRoutes) add(rt *route) {
+	switch rt.mode {
+	case matchExact:
+		hr.exact[rt.rule.Path] = append(hr.exact[rt.rule.Path], rt)
+	case matchPrefix:
+		hr.prefix.insert(rt.rule.Path, rt)
+	default:
+		hr.patterns = append(hr.patterns, rt)
+	}
+}
+
+// Finds the route with the highest precedence matching the request, returns nil if nothing matches
+func (t *routeTable) lookup(hostname string, path string, values *requestValues) *routeMatch {
+	var buf [maxCandidates]*route
+
+	// Gather every route which could match the host & path
+	candidates := t.anyHost.collect(path, buf[:0])
+
+	if hr := t.exactHosts[hostname]; hr != nil {
+		candidates = hr.collect(path, candidates)
+	}
+
+	if dot := strings.IndexByte(hostname, '.'); dot > 0 {
+		if hr := t.wildcardHosts[hostname[dot:]]; hr != nil {
+			candidates = hr.collect(path, candidates)
+		}
+	}
+
+	for _, rt := range t.regexHosts {
+		if rt.matchHost(hostname) {
+			candidates = append(candidates, rt)
+		}
+	}
+
+	// Insertion sort by rank, there are only ever a handful of candidates
+	for i := 1; i < len(candidates); i++ {
+		for j := i; j > 0 && candidates[j].rank < candidates[j-1].rank; j-- {
+			candidates[j], candidates[j-1] = candidates[j-1], candidates[j]
+		}
+	}
+
+	// Now check each in turn, the first to fully match wins
+	for _, rt := range candidates {
+		match := rt.matchPath(path)
+		if match == nil {
+			continue
+		}
+
+		if rt.checkConditions(values) == "" {
+			return match
+		}
+	}
+
+	return nil
+}
+
+// Appends the routes which could match the path to candidates
+func (hr *hostRoutes) collect(path string, candidates []*route) []*route {
+	candidates = append(candidates, hr.exact[path]...)
+	candidates = hr.prefix.walk(path, candidates)
+
+	return append(candidates, hr.patterns...)
+}
+
+// Adds a route to the trie under the given key
+func (n *radixNode) insert(key string, rt *route) {
+	node := n
+
+	for key != "" {
+		var child *radixNode
+
+		childIndex := 0
+
+		for i, c := range node.children {
+			if c.prefix[0] == key[0] {
+				child, childIndex = c, i
+				break
+			}
+		}
+
+		if child == nil {
+			node.children = append(node.children, &radixNode{prefix: key, routes: []*route{rt}})
+			return
+		}
+
+		common := commonPrefixLen(child.prefix, key)
+
+		// Split the child node when the key only shares part of its prefix
+		if common < len(child.prefix) {
+			split := &radixNode{prefix: child.prefix[:common], children: []*radixNode{child}}
+			child.prefix = child.prefix[common:]
+			node.children[childIndex] = split
+			child = split
+		}
+
+		key = key[common:]
+		node = child
+	}
+
+	node.routes = append(node.routes, rt)
+}
+
+// Appends routes for every key in the trie which is a prefix of path
+func (n *radixNode) walk(path string, candidates []*route) []*route {
+	node := n
+
+	for {
+		candidates = append(candidates, node.routes...)
+
+		if path == "" {
+			return candidates
+		}
+
+		var next *radixNode
+
+		for _, c := range node.children {
+			if c.prefix[0] == path[0] {
+				next = c
+				break
+			}
+		}
+
+		if next == nil || !strings.HasPrefix(path, next.prefix) {
+			return candidates
+		}
+
+		path = path[len(next.prefix):]
+		node = next
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
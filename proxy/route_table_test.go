@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+func TestRadixTrie(t *testing.T) {
+	root := &radixNode{}
+	keys := []string{"/", "/api", "/api/v1", "/apple", "/b", "/api/v2", ""}
+
+	for _, key := range keys {
+		root.insert(key, &route{rule: config.Rule{Path: key}})
+	}
+
+	tests := map[string][]string{
+		"/api/v1/users": {"", "/", "/api", "/api/v1"},
+		"/apple":        {"", "/", "/apple"},
+		"/ap":           {"", "/"},
+		"/b":            {"", "/", "/b"},
+		"x":             {""},
+	}
+
+	for path, expected := range tests {
+		found := []string{}
+		for _, rt := range root.walk(path, nil) {
+			found = append(found, rt.rule.Path)
+		}
+
+		if !slices.Equal(found, expected) {
+			t.Errorf("Expected walk of %s to find %v, got %v", path, expected, found)
+		}
+	}
+}
+
+// Finds a match the slow way, by checking every route in order
+func linearLookup(routes []*route, hostname, path string, values *requestValues) *routeMatch {
+	for _, rt := range routes {
+		if !rt.matchHost(hostname) {
+			continue
+		}
+
+		if m := rt.matchPath(path); m != nil && rt.checkConditions(values) == "" {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// Checks the route table gives the same answer as a linear scan, for lots of random rules & requests
+func TestRouteTableMatchesLinear(t *testing.T) {
+	//nolint:gosec
+	rnd := rand.New(rand.NewPCG(1, 2))
+	hosts := []string{"", "a.com", "b.com", "*.a.com", "*.b.com", `^x\d\.a\.com$`}
+	paths := []string{"/", "/api", "/api/v1", "/api/v1/users", "/api/v2", "/static", "/st", "/users/1", ""}
+	modes := []string{matchPrefix, matchPrefix, matchExact, matchGlob, matchRegex}
+
+	for round := 0; round < 50; round++ {
+		routes := []*route{}
+
+		for i := 0; i < 40; i++ {
+			rule := config.Rule{
+				Upstream:  strconv.Itoa(i),
+				Host:      hosts[rnd.IntN(len(hosts))],
+				Path:      paths[rnd.IntN(len(paths))],
+				MatchMode: modes[rnd.IntN(len(modes))],
+				Priority:  rnd.IntN(3) - 1,
+			}
+
+			if rule.Host != "" && rule.Host[0] == '^' {
+				rule.HostMatchMode = matchRegex
+			}
+
+			if rule.MatchMode == matchGlob {
+				rule.Path += "/*"
+			}
+
+			if rnd.IntN(4) == 0 {
+				rule.Methods = []string{http.MethodPost}
+			}
+
+			rt, err := compileRoute(rule)
+			if err != nil {
+				t.Fatalf("Unexpected error compiling %+v: %v", rule, err)
+			}
+
+			routes = append(routes, rt)
+		}
+
+		slices.SortStableFunc(routes, compareRoutes)
+		table := newRouteTable(routes)
+
+		for _, host := range []string{"a.com", "b.com", "www.a.com", "x1.a.com", "c.com", "a.b.com"} {
+			for _, path := range append(paths, "/api/v1/users/2", "/static/x", "/nope") {
+				for _, method := range []string{http.MethodGet, http.MethodPost} {
+					request, _ := http.NewRequest(method, path, nil)
+					values := &requestValues{req: request}
+
+					expected := linearLookup(routes, host, path, values)
+					got := table.lookup(host, path, values)
+
+					if (expected == nil) != (got == nil) || (got != nil && got.route != expected.route) {
+						t.Fatalf("Route table and linear lookup differ for %s %s%s", method, host, path)
+					}
+				}
+			}
+		}
+	}
+}
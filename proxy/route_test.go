@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+func TestRouteInvalid(t *testing.T) {
+	bad := []config.Rule{
+		{Path: "/", MatchMode: "fuzzy"},
+		{Path: "/api/(unclosed", MatchMode: matchRegex},
+	}
+
+	for _, rule := range bad {
+		if _, err := compileRoute(rule); err == nil {
+			t.Errorf("Expected error compiling rule %+v", rule)
+		}
+	}
+}
+
+func TestRouteMatchModes(t *testing.T) {
+	tests := []struct {
+		mode  string
+		path  string
+		req   string
+		match bool
+	}{
+		{"", "/api", "/api/users", true},
+		{matchPrefix, "/api", "/other", false},
+		{matchExact, "/api", "/api", true},
+		{matchExact, "/api", "/api/users", false},
+		{matchRegex, `^/v[0-9]+/orders$`, "/v2/orders", true},
+		{matchRegex, `^/v[0-9]+/orders$`, "/vX/orders", false},
+		{matchGlob, "/users/*/profile", "/users/42/profile", true},
+		{matchGlob, "/users/*/profile", "/users/42/43/profile", false},
+		{matchGlob, "/static/**", "/static/css/site.css", true},
+		{matchGlob, "/file?.txt", "/file1.txt", true},
+		{matchGlob, "/file.txt", "/fileXtxt", false},
+	}
+
+	for _, test := range tests {
+		rt, err := compileRoute(config.Rule{Path: test.path, MatchMode: test.mode})
+		if err != nil {
+			t.Fatalf("Unexpected error compiling %s %s: %v", test.mode, test.path, err)
+		}
+
+		if (rt.matchPath(test.req) != nil) != test.match {
+			t.Errorf("Expected %s match of %s against %s to be %v", test.mode, test.path, test.req, test.match)
+		}
+	}
+}
+
+func TestRouteCaptures(t *testing.T) {
+	rt, _ := compileRoute(config.Rule{Path: `^/legacy/(?P<id>[0-9]+)/(\w+)$`, MatchMode: matchRegex})
+
+	m := rt.matchPath("/legacy/123/details")
+	if m == nil {
+		t.Fatalf("Expected match")
+	}
+
+	if got := m.expand("/items/${id}/$2"); got != "/items/123/details" {
+		t.Errorf("Expected /items/123/details, got %s", got)
+	}
+
+	glob, _ := compileRoute(config.Rule{Path: "/users/*/**", MatchMode: matchGlob})
+
+	m = glob.matchPath("/users/bob/photos/1.jpg")
+	if got := m.expand("/$1/$2"); got != "/bob/photos/1.jpg" {
+		t.Errorf("Expected /bob/photos/1.jpg, got %s", got)
+	}
+}
+
+func TestRouteHostMatching(t *testing.T) {
+	tests := []struct {
+		host     string
+		mode     string
+		hostname string
+		match    bool
+	}{
+		{"", "", "anything.example.com", true},
+		{"example.com", "", "example.com", true},
+		{"Example.COM", "", "example.com", true},
+		{"example.com", "", "www.example.com", false},
+		{"*.example.com", "", "www.example.com", true},
+		{"*.example.com", "", "example.com", false},
+		{"*.example.com", "", "a.b.example.com", false},
+		{"*.example.com", "", "wwwexample.com", false},
+		{`^(api|www)\.example\.com$`, matchRegex, "api.example.com", true},
+		{`^(api|www)\.example\.com$`, matchRegex, "API.example.com", true},
+		{`^(api|www)\.example\.com$`, matchRegex, "cdn.example.com", false},
+	}
+
+	for _, test := range tests {
+		rt, err := compileRoute(config.Rule{Path: "/", Host: test.host, HostMatchMode: test.mode})
+		if err != nil {
+			t.Fatalf("Unexpected error compiling host %s: %v", test.host, err)
+		}
+
+		if rt.matchHost(test.hostname) != test.match {
+			t.Errorf("Expected host %s match against %s to be %v", test.host, test.hostname, test.match)
+		}
+	}
+
+	for _, rule := range []config.Rule{
+		{Path: "/", Host: "(bad", HostMatchMode: matchRegex},
+		{Path: "/", HostMatchMode: matchRegex},
+		{Path: "/", Host: "example.com", HostMatchMode: "fuzzy"},
+	} {
+		if _, err := compileRoute(rule); err == nil {
+			t.Errorf("Expected error compiling rule %+v", rule)
+		}
+	}
+}
+
+func TestRequestHostname(t *testing.T) {
+	for host, expected := range map[string]string{
+		"example.com":      "example.com",
+		"Example.com:8080": "example.com",
+		"[::1]:8080":       "::1",
+		"10.0.0.1":         "10.0.0.1",
+	} {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		request.Host = host
+
+		if got := requestHostname(request); got != expected {
+			t.Errorf("Expected hostname %s from %s, got %s", expected, host, got)
+		}
+	}
+}
+
+func TestRouteOrdering(t *testing.T) {
+	rules := []config.Rule{
+		{Path: "/", Upstream: "catch-all"},
+		{Path: "/api", Upstream: "api"},
+		{Path: "/api/v1", Upstream: "api-v1"},
+		{Path: "/api", MatchMode: matchExact, Upstream: "api-exact"},
+		{Path: "/", Host: "*.example.com", Upstream: "wildcard"},
+		{Path: "/", Host: "www.example.com", Upstream: "www"},
+		{Path: "/", Host: "*.a.example.com", Upstream: "longer-wildcard"},
+		{Path: "/static/**", MatchMode: matchGlob, Upstream: "glob"},
+		{Path: "/api", Methods: []string{"POST"}, Upstream: "api-post"},
+		{Path: "/", Priority: 10, Upstream: "priority"},
+	}
+
+	routes := []*route{}
+
+	for _, rule := range rules {
+		rt, _ := compileRoute(rule)
+		routes = append(routes, rt)
+	}
+
+	slices.SortStableFunc(routes, compareRoutes)
+
+	expected := []string{
+		"priority", "www", "longer-wildcard", "wildcard", "api-exact", "glob", "api-v1", "api-post", "api", "catch-all",
+	}
+
+	for i, rt := range routes {
+		if rt.rule.Upstream != expected[i] {
+			t.Errorf("Expected route %d to be %s, got %s", i, expected[i], rt.rule.Upstream)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy snapshots, the live routing state built from a config
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Where a request is going, the result of routing it with a snapshot
+type decision struct {
+	match     *routeMatch // Nil when no rule matched
+	upstream  *upstream
+	target    *target // Nil when the upstream has no targets available
+	path      string  // Path to send to the upstream
+	rewritten bool    // The path was stripped or rewritten by the rule
+}
+
+// A snapshot holds everything needed to route requests for one version of the config
+// Once built it is never modified, a config reload builds a new snapshot and swaps it in
+type snapshot struct {
+	config     *config.Config
+	upstreams  map[string]*upstream    // Keyed by upstream name
+	routes     []*route                // Compiled rules, sorted in the order they are checked
+	table      *routeTable             // Index of the routes used to route requests
+	listeners  map[int]*streamListener // Stream listeners keyed by port
+	stopChecks context.CancelFunc      // Stops the health checks for the upstreams
+}
+
+// State which outlives a snapshot, kept by the proxy so a config reload doesn't reset it
+type sharedState struct {
+	transports transportCache
+	health     healthCache
+	breakers   breakerCache
+	upgrades   upgradeCounts
+}
+
+// Builds a snapshot from the config, creating the upstreams and compiling the rules
+// Upstreams pick up any state kept from earlier snapshots from shared
+func newSnapshot(conf *config.Config, timeout time.Duration, shared *sharedState) (*snapshot, error) {
+	if conf == nil {
+		// Create empty config to panic and nil pointer errors
+		conf = &config.Config{}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &snapshot{
+		config:    conf,
+		upstreams: make(map[string]*upstream),
+		listeners: make(map[int]*streamListener),
+	}
+
+	// Construct an upstream, with a reverse proxy and its targets, for each upstream in the config
+	for _, u := range conf.Upstreams {
+		up, err := newUpstream(u, timeout, shared)
+		if err != nil {
+			return nil, fmt.Errorf("upstream '%s': %v", u.Name, err)
+		}
+
+		for _, t := range up.targets {
+			slog.Info("Creating upstream", "upstream", up.name, "target", t.url.String())
+		}
+
+		s.upstreams[u.Name] = up
+	}
+
+	// Validate & compile rules into routes
+	for i, rule := range conf.Rules {
+		rt, err := compileRoute(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule for path '%s': %v", rule.Path, err)
+		}
+
+		rt.index = i
+
+		if rule.Path == "" && rule.GRPC == nil {
+			slog.Warn("Rule path is blank, this rule will match all paths", "rule", rt.name)
+		}
+
+		s.routes = append(s.routes, rt)
+	}
+
+	for _, l := range conf.Listeners {
+		sl, err := newStreamListener(l)
+		if err != nil {
+			return nil, fmt.Errorf("listener on port %d: %v", l.Port, err)
+		}
+
+		s.listeners[l.Port] = sl
+	}
+
+	// Most specific routes are checked first, rather than the order of the config file
+	slices.SortStableFunc(s.routes, compareRoutes)
+	s.table = newRouteTable(s.routes)
+
+	if len(conf.Rules) <= 0 {
+		slog.Warn("Config contains no rules")
+	}
+
+	if len(s.upstreams) <= 0 {
+		slog.Warn("Config contains no upstreams")
+	}
+
+	return s, nil
+}
+
+// Starts health checks for any upstreams that have them configured
+// Call stopChecks when the snapshot is no longer used
+func (s *snapshot) startChecks() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopChecks = cancel
+
+	for _, up := range s.upstreams {
+		up.startHealthChecks(ctx)
+	}
+}
+
+// Routes a request, finding the matching rule, the upstream & target, and the path to send
+// Nothing is sent, this is used by both the main handler and explain
+// A dry run reports the target the next request would go to, without changing the state of the balancer
+func (s *snapshot) resolve(r *http.Request, values *requestValues, dryRun bool) decision {
+	d := decision{path: r.URL.Path}
+
+	d.match = s.table.lookup(requestHostname(r), r.URL.Path, values)
+	if d.match == nil {
+		return d
+	}
+
+	rule := d.match.route.rule
+
+	// Routes are only added to the table when their upstream exists
+	d.upstream = s.upstreams[rule.Upstream]
+
+	// Pick which target in the upstream will get this request
+	if dryRun {
+		d.target = d.upstream.peek()
+	} else {
+		d.target = d.upstream.pick()
+	}
+
+	if rule.StripPath || rule.Rewrite != nil {
+		d.path = d.match.rewrite()
+		d.rewritten = true
+	}
+
+	return d
+}
+
+// Name of the matched rule for metrics, blank when no rule matched
+func (d decision) ruleName() string {
+	if d.match == nil {
+		return ""
+	}
+
+	return d.match.route.name
+}
+
+// Name of the upstream for metrics, blank when no rule matched
+func (d decision) upstreamName() string {
+	if d.upstream == nil {
+		return ""
+	}
+
+	return d.upstream.name
+}
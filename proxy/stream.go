@@ -0,0 +1,309 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy stream listeners, raw TCP & TLS passthrough routed by SNI
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// How long a client has to send the TLS ClientHello in passthrough mode
+const streamHelloTimeout = 10 * time.Second
+
+// Reasons a stream connection was rejected, used in metrics
+const (
+	streamBadHello       = "bad-hello"
+	streamNoRoute        = "no-route"
+	streamNoTarget       = "no-target"
+	streamConnectFailure = "connect-failure"
+)
+
+var errHelloRead = errors.New("client hello read")
+
+// A listener from the config, compiled with its SNI routes
+type streamListener struct {
+	conf   config.Listener
+	name   string   // Used in metrics & logs, the listener name or mode & port
+	routes []*route // Only the host of these routes is used, exact names are checked before wildcards
+}
+
+// The ports open for stream listeners, which are opened & closed as the config changes
+type streamServers struct {
+	mu        sync.Mutex
+	listeners map[int]net.Listener
+}
+
+// Compiles a listener from the config, server names are matched the same way as rule hosts
+func newStreamListener(l config.Listener) (*streamListener, error) {
+	if l.Mode == "" {
+		l.Mode = config.ListenerTCP
+	}
+
+	sl := &streamListener{conf: l, name: l.Name}
+	if sl.name == "" {
+		sl.name = l.Mode + "-" + strconv.Itoa(l.Port)
+	}
+
+	for _, r := range l.Routes {
+		rt := &route{rule: config.Rule{Host: r.ServerName, Upstream: r.Upstream}}
+		if err := rt.compileHost(); err != nil {
+			return nil, err
+		}
+
+		sl.routes = append(sl.routes, rt)
+	}
+
+	slices.SortStableFunc(sl.routes, func(a, b *route) int {
+		return boolToInt(a.hostMode == matchWildcard) - boolToInt(b.hostMode == matchWildcard)
+	})
+
+	return sl, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// Finds the upstream for a connection, serverName is blank in TCP mode or when the client didn't send one
+func (sl *streamListener) upstreamFor(serverName string) string {
+	for _, rt := range sl.routes {
+		if serverName != "" && rt.matchHost(serverName) {
+			return rt.rule.Upstream
+		}
+	}
+
+	return sl.conf.Upstream
+}
+
+// Opens listeners for ports added to the config and closes those removed, a port which fails to open
+// is tried again on the next reload. Connections already open carry on until they finish
+func (ss *streamServers) sync(np *NanoProxy, s *snapshot) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.listeners == nil {
+		ss.listeners = make(map[int]net.Listener)
+	}
+
+	for port, ln := range ss.listeners {
+		if s.listeners[port] == nil {
+			slog.Info("Closing stream listener", "port", port)
+
+			_ = ln.Close()
+			delete(ss.listeners, port)
+		}
+	}
+
+	for port, sl := range s.listeners {
+		if ss.listeners[port] != nil {
+			continue
+		}
+
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			slog.Error("Failed to open stream listener", "listener", sl.name, "port", port, "error", err)
+			continue
+		}
+
+		slog.Info("Stream listener accepting connections", "listener", sl.name, "port", port, "mode", sl.conf.Mode)
+
+		ss.listeners[port] = ln
+
+		go np.acceptStreams(ln, port)
+	}
+}
+
+// Accepts connections until the listener is closed
+func (np *NanoProxy) acceptStreams(ln net.Listener, port int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Stream listener error", "port", port, "error", err)
+			}
+
+			return
+		}
+
+		go np.serveStream(conn, port)
+	}
+}
+
+// Forwards a connection to a target of the upstream, using the listener settings from the live config
+func (np *NanoProxy) serveStream(conn net.Conn, port int) {
+	defer conn.Close()
+
+	state := np.current()
+
+	sl := state.listeners[port]
+	if sl == nil {
+		return
+	}
+
+	logger := slog.With("listener", sl.name, "client", conn.RemoteAddr().String())
+
+	// In passthrough mode the ClientHello is read to get the server name, then sent on to the target
+	var serverName string
+
+	var hello []byte
+
+	if sl.conf.Mode == config.ListenerTLSPassthrough {
+		var err error
+
+		_ = conn.SetReadDeadline(time.Now().Add(streamHelloTimeout))
+		serverName, hello, err = peekServerName(conn)
+		_ = conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			logger.Debug("Failed to read TLS ClientHello", "error", err)
+			metricStreamRejected.WithLabelValues(sl.name, streamBadHello).Inc()
+
+			return
+		}
+
+		logger = logger.With("serverName", serverName)
+	}
+
+	up := state.upstreams[sl.upstreamFor(serverName)]
+	if up == nil {
+		logger.Debug("No route for connection")
+		metricStreamRejected.WithLabelValues(sl.name, streamNoRoute).Inc()
+
+		return
+	}
+
+	t := up.pick()
+	if t == nil {
+		logger.Warn("No targets available for upstream", "upstream", up.name)
+		metricStreamRejected.WithLabelValues(sl.name, streamNoTarget).Inc()
+
+		return
+	}
+
+	t.active.Add(1)
+	defer t.active.Add(-1)
+
+	dialer := &net.Dialer{Timeout: up.timeouts.Connect}
+
+	backend, err := dialer.DialContext(context.Background(), "tcp", t.url.Host)
+	if err != nil {
+		logger.Warn("Failed to connect to target", "upstream", up.name, "target", t.url.Host, "error", err)
+		up.recordResult(t, 0, err)
+		recordUpstreamError(t, err)
+		metricStreamRejected.WithLabelValues(sl.name, streamConnectFailure).Inc()
+
+		return
+	}
+
+	// Same as upgraded HTTP connections, the connection to the target is closed when idle
+	// A status of 0 with no error counts as a success for outlier detection
+	up.recordResult(t, 0, nil)
+
+	tc := newUpgradedConn(backend, config.Upgrade{IdleTimeout: sl.conf.IdleTimeout})
+
+	if len(hello) > 0 {
+		if _, err := tc.Write(hello); err != nil {
+			_ = tc.Close()
+			return
+		}
+	}
+
+	active := metricStreamActive.WithLabelValues(sl.name)
+	active.Inc()
+
+	pipe(conn, tc)
+	_ = tc.Close()
+
+	active.Dec()
+	metricStreams.WithLabelValues(sl.name, up.name, tc.reason).Inc()
+	metricStreamBytes.WithLabelValues(sl.name, "to_upstream").Add(float64(tc.toUpstream.Load()))
+	metricStreamBytes.WithLabelValues(sl.name, "to_client").Add(float64(tc.toClient.Load()))
+
+	logger.Info("Stream connection closed", "upstream", up.name, "target", t.url.Host, "reason", tc.reason,
+		"duration", tc.ended.Sub(tc.opened).String(), "bytesToUpstream", tc.toUpstream.Load(),
+		"bytesToClient", tc.toClient.Load())
+}
+
+// Copies data both ways until both sides have finished sending, or either side fails
+// Each side is half closed when the other has finished, so protocols which rely on that still work
+func pipe(client net.Conn, backend *upgradedConn) {
+	errc := make(chan error, 2)
+
+	copyHalf := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		if err == nil {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				err = cw.CloseWrite()
+			}
+		}
+
+		errc <- err
+	}
+
+	go copyHalf(backend, client)
+	go copyHalf(client, backend)
+
+	// Wait for both directions, when one fails closing the connections stops the other
+	for range 2 {
+		if err := <-errc; err != nil {
+			_ = client.Close()
+			_ = backend.Close()
+		}
+	}
+}
+
+// Reads the TLS ClientHello from the connection without responding, returning the server name it asks
+// for and the bytes read so they can be sent on to the target
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+
+	var hello *tls.ClientHelloInfo
+
+	//nolint:gosec
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return "", nil, fmt.Errorf("not a TLS connection: %v", err)
+	}
+
+	return hello.ServerName, buf.Bytes(), nil
+}
+
+// A connection which can only be read from, used to parse the ClientHello without the TLS server
+// writing anything back to the client
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(_ time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Backend which sends back everything it receives over TCP
+func newTCPEchoBackend(t *testing.T) config.Target {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return config.Target{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+}
+
+// Finds a port which is free to listen on
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestStreamTCP(t *testing.T) {
+	port := freePort(t)
+
+	newTestProxy(t, &config.Config{
+		Upstreams: []config.Upstream{{Name: "echo", Targets: []config.Target{newTCPEchoBackend(t)}}},
+		Listeners: []config.Listener{{Name: "stream-echo", Port: port, Upstream: "echo"}},
+	})
+
+	// Metrics are global, so count from where other tests (or runs) left them
+	closed := metricStreams.WithLabelValues("stream-echo", "echo", upgradeClosed)
+	closedBefore := testutil.ToFloat64(closed)
+	sent := metricStreamBytes.WithLabelValues("stream-echo", "to_upstream")
+	sentBefore := testutil.ToFloat64(sent)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("Failed to connect to listener: %v", err)
+	}
+
+	_, _ = conn.Write([]byte("hello"))
+
+	// Half closing tells the backend we're done, it then closes its side after echoing everything back
+	_ = conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "hello" {
+		t.Errorf("Expected 'hello' echoed back, got '%s' %v", reply, err)
+	}
+
+	_ = conn.Close()
+
+	waitFor(t, "connection closed metric", func() bool {
+		return testutil.ToFloat64(closed) == closedBefore+1
+	})
+
+	if count := testutil.ToFloat64(sent); count != sentBefore+5 {
+		t.Errorf("Expected 5 bytes sent to the upstream, got %v", count-sentBefore)
+	}
+}
+
+func TestStreamTLSPassthrough(t *testing.T) {
+	serverA := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("a"))
+	}))
+	t.Cleanup(serverA.Close)
+
+	serverB := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("b"))
+	}))
+	t.Cleanup(serverB.Close)
+
+	port := freePort(t)
+
+	newTestProxy(t, &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "a", Targets: []config.Target{serverTarget(serverA)}},
+			{Name: "b", Targets: []config.Target{serverTarget(serverB)}},
+		},
+		Listeners: []config.Listener{{
+			Name: "stream-sni",
+			Port: port,
+			Mode: config.ListenerTLSPassthrough,
+			Routes: []config.SNIRoute{
+				{ServerName: "*.example.net", Upstream: "b"},
+				{ServerName: "a.example.net", Upstream: "a"},
+			},
+		}},
+	})
+
+	rejected := metricStreamRejected.WithLabelValues("stream-sni", streamNoRoute)
+	rejectedBefore := testutil.ToFloat64(rejected)
+
+	tests := map[string]*httptest.Server{
+		"a.example.net":   serverA,
+		"www.example.net": serverB,
+	}
+
+	for serverName, expected := range tests {
+		//nolint:gosec
+		conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Errorf("%s: TLS handshake through listener failed: %v", serverName, err)
+			continue
+		}
+
+		// The TLS is not terminated by the proxy, so the client sees the certificate of the target
+		if !conn.ConnectionState().PeerCertificates[0].Equal(expected.Certificate()) {
+			t.Errorf("%s: expected the certificate of the target", serverName)
+		}
+
+		_ = conn.Close()
+	}
+
+	// No route matches and there's no default upstream, so the connection is dropped
+	//nolint:gosec
+	if _, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{
+		ServerName:         "other.example.com",
+		InsecureSkipVerify: true,
+	}); err == nil {
+		t.Errorf("Expected connection without a route to be dropped")
+	}
+
+	if count := testutil.ToFloat64(rejected); count != rejectedBefore+1 {
+		t.Errorf("Expected 1 connection rejected with no route, got %v", count-rejectedBefore)
+	}
+}
+
+func TestStreamListenerReload(t *testing.T) {
+	port := freePort(t)
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	upstreams := []config.Upstream{{Name: "echo", Targets: []config.Target{newTCPEchoBackend(t)}}}
+
+	np := newTestProxy(t, &config.Config{
+		Upstreams: upstreams,
+		Listeners: []config.Listener{{Port: port, Upstream: "echo"}},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected listener to be open: %v", err)
+	}
+
+	// Make sure the connection has reached the backend before the reload
+	ping := make([]byte, 4)
+	_, _ = conn.Write([]byte("ping"))
+
+	if _, err := io.ReadFull(conn, ping); err != nil {
+		t.Fatalf("Expected ping echoed back: %v", err)
+	}
+
+	// Removing the listener closes the port, but open connections carry on
+	mustApplyConfig(t, np, &config.Config{Upstreams: upstreams})
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Expected listener to be closed after reload")
+	}
+
+	_, _ = conn.Write([]byte("still here"))
+	_ = conn.(*net.TCPConn).CloseWrite()
+
+	if reply, _ := io.ReadAll(conn); string(reply) != "still here" {
+		t.Errorf("Expected open connection to keep working, got '%s'", reply)
+	}
+}
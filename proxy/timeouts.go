@@ -0,0 +1,74 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy timeouts, for upstream connections and whole requests
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Idle connections are kept this long by default, the same as the http.DefaultTransport
+const timeoutDefaultIdle = 90 * time.Second
+
+var (
+	// Cause of the context being cancelled when a rule's timeout is reached
+	errRequestTimeout = errors.New("request timeout")
+
+	// Cause of the context being cancelled when the upstream is too slow to send the response headers
+	errHeaderTimeout = errors.New("timeout awaiting response headers")
+)
+
+// Returns the upstream timeouts with defaults filled in, unset timeouts use the global timeout
+func timeoutDefaults(to *config.Timeouts, timeout time.Duration) config.Timeouts {
+	t := config.Timeouts{}
+	if to != nil {
+		t = *to
+	}
+
+	if t.Connect <= 0 {
+		t.Connect = timeout
+	}
+
+	if t.TLSHandshake <= 0 {
+		t.TLSHandshake = timeout
+	}
+
+	if t.ResponseHeader <= 0 {
+		t.ResponseHeader = timeout
+	}
+
+	if t.Idle <= 0 {
+		t.Idle = timeoutDefaultIdle
+	}
+
+	return t
+}
+
+// Checks if the error is from any kind of timeout, rather than the upstream failing
+func isTimeout(err error) bool {
+	if errors.Is(err, errRequestTimeout) || errors.Is(err, errHeaderTimeout) || errors.Is(err, errPerTryTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Status code sent to the client when proxying fails, 504 for timeouts and 502 for everything else
+func errorStatus(err error) int {
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
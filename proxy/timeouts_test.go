@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Backend which waits before sending the response headers, then streams the body slowly
+func newSlowBackend(t *testing.T, headerDelay time.Duration, bodyDelay time.Duration) config.Target {
+	return newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(headerDelay):
+		case <-r.Context().Done():
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		for i := 0; i < 4; i++ {
+			_, _ = w.Write([]byte("chunk"))
+			http.NewResponseController(w).Flush()
+			time.Sleep(bodyDelay / 4)
+		}
+	})
+}
+
+func TestTimeoutsResponseHeader(t *testing.T) {
+	slow := newSlowBackend(t, 300*time.Millisecond, 0)
+	streaming := newSlowBackend(t, 0, 200*time.Millisecond)
+
+	headerTimeout := &config.Timeouts{ResponseHeader: 50 * time.Millisecond}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "slow", Targets: []config.Target{slow}, Timeouts: headerTimeout},
+			{Name: "stream", Targets: []config.Target{streaming}, Timeouts: headerTimeout},
+		},
+		Rules: []config.Rule{
+			{Path: "/report", Upstream: "slow", Timeout: 2 * time.Second},
+			{Path: "/deadline", Upstream: "slow", Timeout: 100 * time.Millisecond},
+			{Path: "/slow", Upstream: "slow"},
+			{Path: "/stream", Upstream: "stream"},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/slow", http.StatusGatewayTimeout, ""},
+		{"/report", http.StatusOK, "chunkchunkchunkchunk"},
+		{"/deadline", http.StatusGatewayTimeout, ""},
+		{"/stream", http.StatusOK, "chunkchunkchunkchunk"},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest(http.MethodGet, test.path, nil)
+		response := httptest.NewRecorder()
+		np.mainHandler(response, request)
+
+		if response.Code != test.status || !strings.HasPrefix(response.Body.String(), test.body) {
+			t.Errorf("%s: expected %d '%s', got %d '%s'", test.path, test.status, test.body, response.Code,
+				response.Body.String())
+		}
+	}
+}
+
+func TestTimeoutsDefaults(t *testing.T) {
+	to := timeoutDefaults(&config.Timeouts{Connect: time.Second}, 3*time.Second)
+
+	if to.Connect != time.Second || to.TLSHandshake != 3*time.Second || to.ResponseHeader != 3*time.Second ||
+		to.Idle != timeoutDefaultIdle {
+		t.Errorf("Unexpected timeouts %+v", to)
+	}
+
+	if errorStatus(errHeaderTimeout) != http.StatusGatewayTimeout || errorStatus(errRetry) != http.StatusBadGateway {
+		t.Errorf("Expected timeouts to give a 504 and other errors a 502")
+	}
+}
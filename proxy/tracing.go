@@ -0,0 +1,135 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy distributed tracing with OpenTelemetry
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/benc-uk/nanoproxy/proxy"
+
+// Sets up tracing when an OTLP endpoint is configured, using the standard OTEL_EXPORTER_OTLP_* env vars
+// Returns a func to flush & stop the exporter, or nil when tracing is not enabled
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "nanoproxy"
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+		semconv.HostName(hostname),
+	)
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// Spans are created with the global provider, which does nothing until setupTracing is called
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Starts the server span for a request coming into the proxy, continuing any trace from the caller
+func startServerSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	ctx, span := tracer().Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLPath(r.URL.Path),
+		semconv.ServerAddress(r.Host),
+		semconv.UserAgentOriginal(r.UserAgent()),
+	))
+
+	return r.WithContext(ctx), span
+}
+
+// Finishes the server span, with the routing decision and status sent to the client
+func endServerSpan(span trace.Span, r *http.Request, d decision, status int) {
+	if id := requestIDFromContext(r.Context()); id != nil {
+		span.SetAttributes(attribute.String("nanoproxy.request_id", id.value))
+	}
+
+	if d.match != nil {
+		span.SetName(r.Method + " " + d.ruleName())
+		span.SetAttributes(attribute.String("nanoproxy.rule", d.ruleName()),
+			attribute.String("nanoproxy.upstream", d.upstreamName()))
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+
+	span.End()
+}
+
+// Starts the client span for a request sent to an upstream target
+func startClientSpan(r *http.Request, t *target) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(r.Context(), r.Method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.ServerAddress(t.url.Hostname()),
+		semconv.ServerPort(portNumber(t.url.Port())),
+		attribute.String("nanoproxy.upstream", t.upstream.name),
+	))
+
+	return r.WithContext(ctx), span
+}
+
+// Finishes the client span, with the status from the upstream or the error if it failed
+func endClientSpan(span trace.Span, info *proxyInfo) {
+	if info.err != nil {
+		span.RecordError(info.err)
+		span.SetStatus(codes.Error, info.err.Error())
+	} else {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(info.status))
+
+		if info.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(info.status))
+		}
+	}
+
+	span.End()
+}
+
+// Converts a port from a URL to a number, which is always valid as we built the URL
+func portNumber(port string) int {
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Adds the trace context to the request going to the upstream, so the trace carries on there
+func injectTraceContext(out *http.Request) {
+	otel.GetTextMapPropagator().Inject(out.Context(), propagation.HeaderCarrier(out.Header))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Sets the global tracer provider & propagator for a test, afterwards tracing is switched off again
+func useTracerProvider(t *testing.T, provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	useTracerProvider(t, sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// Backend which captures the traceparent header sent by the proxy
+	received := ""
+	backend := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+	})
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{{Name: "traced", Targets: []config.Target{backend}}},
+		Rules:     []config.Rule{{Name: "trace-rule", Path: "/", Upstream: "traced"}},
+	})
+
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	np.mainHandler(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	// Client span ends first, as it's inside the server span
+	client, server := spans[0], spans[1]
+
+	if server.SpanKind() != trace.SpanKindServer || server.Name() != "GET trace-rule" {
+		t.Errorf("Unexpected server span %s %v", server.Name(), server.SpanKind())
+	}
+
+	if server.SpanContext().TraceID().String() != traceID || server.Parent().SpanID().String() != parentID {
+		t.Errorf("Expected server span to continue the incoming trace, got parent %v", server.Parent())
+	}
+
+	if client.SpanKind() != trace.SpanKindClient || client.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected client span to be a child of the server span")
+	}
+
+	expected := "00-" + traceID + "-" + client.SpanContext().SpanID().String() + "-01"
+	if received != expected {
+		t.Errorf("Expected upstream to get traceparent %s, got %s", expected, received)
+	}
+}
+
+func TestTracingOTLPExport(t *testing.T) {
+	// A tiny in-process collector, which just counts the export requests it gets
+	var exports atomic.Int32
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			exports.Add(1)
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	useTracerProvider(t, noop.NewTracerProvider())
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	shutdown, err := setupTracing(context.Background())
+	if err != nil || shutdown == nil {
+		t.Fatalf("Expected tracing to be enabled, got error %v", err)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	_, span := startServerSpan(request)
+	span.End()
+
+	// Shutdown flushes the batch of spans to the collector
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Unexpected error flushing spans: %v", err)
+	}
+
+	if exports.Load() == 0 {
+		t.Errorf("Expected spans to be exported to the collector")
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	shutdown, err := setupTracing(context.Background())
+	if err != nil || shutdown != nil {
+		t.Errorf("Expected tracing to be disabled")
+	}
+
+	// With no propagator the incoming traceparent is passed through untouched
+	received := ""
+	backend := newHandlerBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+	})
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{{Name: "untraced", Targets: []config.Target{backend}}},
+		Rules:     []config.Rule{{Path: "/", Upstream: "untraced"}},
+	})
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	request, _ := http.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("traceparent", traceparent)
+	np.mainHandler(httptest.NewRecorder(), request)
+
+	if !strings.EqualFold(received, traceparent) {
+		t.Errorf("Expected traceparent to be passed through, got %s", received)
+	}
+}
@@ -0,0 +1,150 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy transports, pools of connections to upstream targets
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Idle connections kept per target by default, much higher than the net/http default of 2 as a proxy
+// sends a lot of requests to a few hosts
+const poolDefaultMaxIdle = 100
+
+// Everything which affects how connections to a target are made
+type transportSettings struct {
+	timeouts      config.Timeouts
+	pool          config.ConnectionPool
+	protocol      string
+	skipTLSVerify bool
+}
+
+// Transports are shared by all snapshots of a proxy and looked up by target & settings, so a config reload
+// keeps the warm connections to targets which haven't changed
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// Returns the settings for the targets of an upstream, with defaults filled in
+func newTransportSettings(u config.Upstream, timeouts config.Timeouts) transportSettings {
+	s := transportSettings{
+		timeouts:      timeouts,
+		protocol:      u.Protocol,
+		skipTLSVerify: os.Getenv("TLS_SKIP_VERIFY") != "",
+	}
+
+	if u.ConnectionPool != nil {
+		s.pool = *u.ConnectionPool
+	}
+
+	if s.pool.MaxIdleConns <= 0 {
+		s.pool.MaxIdleConns = poolDefaultMaxIdle
+	}
+
+	if s.protocol == "" {
+		s.protocol = config.ProtocolHTTP1
+	}
+
+	return s
+}
+
+// Returns the transport for a target, creating it if there isn't one with the same settings
+func (c *transportCache) get(target *url.URL, s transportSettings) *http.Transport {
+	key := fmt.Sprintf("%s %+v", target.String(), s)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.transports == nil {
+		c.transports = make(map[string]*http.Transport)
+	}
+
+	if t, ok := c.transports[key]; ok {
+		return t
+	}
+
+	t := newTransport(s)
+	c.transports[key] = t
+
+	return t
+}
+
+// Drops the transports not used by the snapshot, closing their idle connections
+// Requests still in flight on an old snapshot carry on using the transport they have
+func (c *transportCache) retain(s *snapshot) {
+	used := make(map[*http.Transport]bool)
+
+	for _, up := range s.upstreams {
+		for _, t := range up.targets {
+			used[t.transport] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, t := range c.transports {
+		if !used[t] {
+			t.CloseIdleConnections()
+			delete(c.transports, key)
+		}
+	}
+}
+
+// Builds a transport with the timeouts, pool settings & protocol
+// The response header timeout isn't set here, it's handled per request as rules can override it
+func newTransport(s transportSettings) *http.Transport {
+	t := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   s.timeouts.Connect,
+			KeepAlive: s.pool.KeepAlive,
+		}).DialContext,
+		TLSHandshakeTimeout: s.timeouts.TLSHandshake,
+		IdleConnTimeout:     s.timeouts.Idle,
+		MaxIdleConnsPerHost: s.pool.MaxIdleConns,
+		MaxConnsPerHost:     s.pool.MaxConns,
+		DisableKeepAlives:   s.pool.DisableKeepAlives,
+
+		//nolint:gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: s.skipTLSVerify},
+	}
+
+	protocols := &http.Protocols{}
+
+	switch s.protocol {
+	case config.ProtocolH2:
+		protocols.SetHTTP2(true)
+	case config.ProtocolH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+
+	t.Protocols = protocols
+
+	return t
+}
+
+// Sends each request with the transport of the target picked for it
+type targetTransport struct{}
+
+func (targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := targetFromContext(req.Context())
+	if t == nil {
+		return nil, errors.New("no target set for request")
+	}
+
+	return t.transport.RoundTrip(req)
+}
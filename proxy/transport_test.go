@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Backend which responds with the protocol of the request it received
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(r.Proto))
+}
+
+func TestTransportProtocols(t *testing.T) {
+	t.Setenv("TLS_SKIP_VERIFY", "1")
+
+	plain := httptest.NewUnstartedServer(http.HandlerFunc(protoHandler))
+	plain.Config.Protocols = &http.Protocols{}
+	plain.Config.Protocols.SetHTTP1(true)
+	plain.Config.Protocols.SetUnencryptedHTTP2(true)
+	plain.Start()
+	t.Cleanup(plain.Close)
+
+	secure := httptest.NewUnstartedServer(http.HandlerFunc(protoHandler))
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	t.Cleanup(secure.Close)
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, &config.Config{
+		Upstreams: []config.Upstream{
+			{Name: "h1", Targets: []config.Target{serverTarget(plain)}},
+			{Name: "h2c", Targets: []config.Target{serverTarget(plain)}, Protocol: config.ProtocolH2C},
+			{Name: "tls", Scheme: "https", Targets: []config.Target{serverTarget(secure)}},
+			{Name: "h2", Scheme: "https", Targets: []config.Target{serverTarget(secure)}, Protocol: config.ProtocolH2},
+		},
+		Rules: []config.Rule{
+			{Path: "/h1", Upstream: "h1"},
+			{Path: "/h2c", Upstream: "h2c"},
+			{Path: "/tls", Upstream: "tls"},
+			{Path: "/h2", Upstream: "h2"},
+		},
+	})
+
+	tests := map[string]string{
+		"/h1":  "HTTP/1.1",
+		"/h2c": "HTTP/2.0",
+		"/tls": "HTTP/1.1",
+		"/h2":  "HTTP/2.0",
+	}
+
+	for path, expected := range tests {
+		request, _ := http.NewRequest(http.MethodGet, path, nil)
+		response := httptest.NewRecorder()
+		np.mainHandler(response, request)
+
+		if response.Code != http.StatusOK || response.Body.String() != expected {
+			t.Errorf("%s: expected upstream request with %s, got %d '%s'", path, expected, response.Code,
+				response.Body.String())
+		}
+	}
+}
+
+func TestTransportSharedAcrossReloads(t *testing.T) {
+	backend := newBackend(t, "a")
+
+	conf := func(pool *config.ConnectionPool) *config.Config {
+		return &config.Config{
+			Upstreams: []config.Upstream{{Name: "pooled", Targets: []config.Target{backend}, ConnectionPool: pool}},
+			Rules:     []config.Rule{{Path: "/", Upstream: "pooled"}},
+		}
+	}
+
+	np := &NanoProxy{}
+	mustApplyConfig(t, np, conf(nil))
+	first := np.current().upstreams["pooled"].targets[0].transport
+
+	mustApplyConfig(t, np, conf(nil))
+	second := np.current().upstreams["pooled"].targets[0].transport
+
+	if first != second {
+		t.Errorf("Expected the transport to be kept when the config is reloaded")
+	}
+
+	mustApplyConfig(t, np, conf(&config.ConnectionPool{MaxIdleConns: 5, MaxConns: 10}))
+	third := np.current().upstreams["pooled"].targets[0].transport
+
+	if third == second || third.MaxIdleConnsPerHost != 5 || third.MaxConnsPerHost != 10 {
+		t.Errorf("Expected a new transport with the pool settings when they change")
+	}
+
+	for _, tr := range np.shared.transports.transports {
+		if tr == second {
+			t.Errorf("Expected the old transport to be dropped")
+		}
+	}
+
+	// Another proxy has its own transports, so reloading it leaves these open
+	mustApplyConfig(t, &NanoProxy{}, &config.Config{})
+
+	if len(np.shared.transports.transports) != 1 {
+		t.Errorf("Expected the transport to be kept when another proxy is reloaded")
+	}
+}
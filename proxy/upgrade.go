@@ -0,0 +1,286 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy upgraded connections, e.g. WebSockets, with timeouts & limits
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// Upgraded connections with no data sent either way for this long are closed, unless set in the config
+const upgradeDefaultIdle = 5 * time.Minute
+
+// Reasons an upgraded connection was closed
+const (
+	upgradeClosed      = "closed"
+	upgradeIdleTimeout = "idle-timeout"
+	upgradeMaxDuration = "max-duration"
+)
+
+var errUpgradeLimit = errors.New("too many upgraded connections for upstream")
+
+// An upgrade request being proxied, from when it is admitted until the connection is closed
+type upgradeSession struct {
+	conf     config.Upgrade // Idle & max duration, zero when the rule hasn't opted into long-lived upgrades
+	upstream *upstream
+	protocol string          // Requested in the Upgrade header, e.g. 'websocket'
+	conn     *upgradedConn   // Set once the upstream has switched protocols
+	onSwitch func()          // Called when the upstream switches protocols, can be nil
+	ctx      context.Context // For logging, carries the request ID
+}
+
+// The connection to the upstream once protocols have been switched, it counts the bytes sent each way
+// and is closed when idle or open for too long, which in turn closes the connection to the client
+type upgradedConn struct {
+	io.ReadWriteCloser
+	opened     time.Time
+	idle       time.Duration
+	lastActive atomic.Int64 // Time of the last read or write, in unix nanoseconds
+	closed     atomic.Bool
+	toUpstream atomic.Int64
+	toClient   atomic.Int64
+	maxTimer   *time.Timer // Nil when there is no max duration, stopped when the session ends
+
+	once   sync.Once
+	reason string // Why the connection was closed, set once
+	ended  time.Time
+}
+
+// Context key used to pass the upgrade session through to the reverse proxy
+type upgradeKey struct{}
+
+// Counts of upgraded connections are shared by all snapshots of a proxy and looked up by upstream name,
+// so connections opened before a config reload still count towards the upstream's limit
+type upgradeCounts struct {
+	mu     sync.Mutex
+	counts map[string]*atomic.Int64
+}
+
+// Returns the count of upgraded connections for the upstream, creating it if there isn't one
+func (c *upgradeCounts) get(upstream string) *atomic.Int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]*atomic.Int64)
+	}
+
+	if n, ok := c.counts[upstream]; ok {
+		return n
+	}
+
+	n := &atomic.Int64{}
+	c.counts[upstream] = n
+
+	return n
+}
+
+// Drops the counts of upstreams which aren't in the snapshot, unless they still have connections open
+func (c *upgradeCounts) retain(s *snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, n := range c.counts {
+		if s.upstreams[name] == nil && n.Load() == 0 {
+			delete(c.counts, name)
+		}
+	}
+}
+
+// Returns a copy of the upgrade config with defaults filled in
+func upgradeDefaults(up config.Upgrade) config.Upgrade {
+	if up.IdleTimeout <= 0 {
+		up.IdleTimeout = upgradeDefaultIdle
+	}
+
+	return up
+}
+
+// Checks if the request asks to switch protocols, only HTTP/1.1 has upgrades
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Admits an upgrade request to the upstream, or returns an error when the upstream is at its limit
+// The config is nil when the rule hasn't opted into long-lived upgrades. Once admitted end must be called
+func (u *upstream) beginUpgrade(r *http.Request, conf *config.Upgrade) (*upgradeSession, error) {
+	if n := u.upgrades.Add(1); u.maxUpgrades > 0 && n > int64(u.maxUpgrades) {
+		u.upgrades.Add(-1)
+		metricUpgradesRejected.WithLabelValues(u.name).Inc()
+
+		return nil, errUpgradeLimit
+	}
+
+	s := &upgradeSession{
+		upstream: u,
+		protocol: strings.ToLower(r.Header.Get("Upgrade")),
+		ctx:      r.Context(),
+	}
+
+	if conf != nil {
+		s.conf = *conf
+	}
+
+	return s, nil
+}
+
+// Fetch the upgrade session for the request, if any
+func upgradeFromContext(ctx context.Context) *upgradeSession {
+	s, _ := ctx.Value(upgradeKey{}).(*upgradeSession)
+	return s
+}
+
+// Called when the upstream switches protocols, the connection is wrapped so the reverse proxy copies
+// through it. Nothing is done if the body isn't a connection, the reverse proxy reports that
+func (s *upgradeSession) switched(resp *http.Response) {
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+
+	s.conn = newUpgradedConn(rwc, s.conf)
+	resp.Body = s.conn
+
+	metricUpgradesActive.WithLabelValues(s.upstream.name).Inc()
+	slog.DebugContext(s.ctx, "Upgraded connection opened", "upstream", s.upstream.name, "protocol", s.protocol)
+
+	if s.onSwitch != nil {
+		s.onSwitch()
+	}
+}
+
+// Frees up the upstream's connection limit, and records the metrics & logs for the upgraded connection
+func (s *upgradeSession) end() {
+	s.upstream.upgrades.Add(-1)
+
+	c := s.conn
+	if c == nil {
+		return
+	}
+
+	// The reverse proxy closes the connection in the background, so make sure it's closed here
+	_ = c.Close()
+
+	if c.maxTimer != nil {
+		c.maxTimer.Stop()
+	}
+
+	name := s.upstream.name
+	duration := c.ended.Sub(c.opened)
+
+	metricUpgradesActive.WithLabelValues(name).Dec()
+	metricUpgrades.WithLabelValues(name, c.reason).Inc()
+	metricUpgradeDuration.WithLabelValues(name).Observe(duration.Seconds())
+	metricUpgradeBytes.WithLabelValues(name, "to_upstream").Add(float64(c.toUpstream.Load()))
+	metricUpgradeBytes.WithLabelValues(name, "to_client").Add(float64(c.toClient.Load()))
+
+	slog.InfoContext(s.ctx, "Upgraded connection closed", "upstream", name, "protocol", s.protocol,
+		"reason", c.reason, "duration", duration.String(), "bytesToUpstream", c.toUpstream.Load(),
+		"bytesToClient", c.toClient.Load())
+}
+
+func newUpgradedConn(rwc io.ReadWriteCloser, conf config.Upgrade) *upgradedConn {
+	c := &upgradedConn{ReadWriteCloser: rwc, opened: time.Now(), idle: conf.IdleTimeout}
+	c.lastActive.Store(c.opened.UnixNano())
+
+	if c.idle > 0 {
+		time.AfterFunc(c.idle, c.checkIdle)
+	}
+
+	if conf.MaxDuration > 0 {
+		c.maxTimer = time.AfterFunc(conf.MaxDuration, func() { _ = c.closeWith(upgradeMaxDuration) })
+	}
+
+	return c
+}
+
+// Reads from the upstream, which the reverse proxy sends on to the client
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.toClient.Add(int64(n))
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Writes to the upstream what the reverse proxy has read from the client
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.toUpstream.Add(int64(n))
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+func (c *upgradedConn) Close() error {
+	return c.closeWith(upgradeClosed)
+}
+
+// Half closes the connection when it's TCP, so the other end sees the end of the stream
+// Otherwise the connection is closed completely
+func (c *upgradedConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// Closes the connection, recording the reason if it's the first close
+func (c *upgradedConn) closeWith(reason string) error {
+	var err error
+
+	c.once.Do(func() {
+		c.reason = reason
+		c.ended = time.Now()
+		c.closed.Store(true)
+
+		err = c.ReadWriteCloser.Close()
+	})
+
+	return err
+}
+
+// Closes the connection if nothing has been sent either way for the idle timeout, otherwise checks again
+// when it would next be idle for that long
+func (c *upgradedConn) checkIdle() {
+	if c.closed.Load() {
+		return
+	}
+
+	idleFor := time.Since(time.Unix(0, c.lastActive.Load()))
+	if idleFor >= c.idle {
+		_ = c.closeWith(upgradeIdleTimeout)
+		return
+	}
+
+	time.AfterFunc(c.idle-idleFor, c.checkIdle)
+}
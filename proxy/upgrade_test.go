@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Backend which switches to an 'echo' protocol, sending back every line it receives
+func newUpgradeBackend(t *testing.T) config.Target {
+	t.Helper()
+
+	return newHandlerBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) || r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			_, _ = brw.WriteString(line)
+			_ = brw.Flush()
+		}
+	}))
+}
+
+// Serves the proxy on a real connection, as upgrades need to hijack it, and returns its address
+func serveProxy(t *testing.T, np *NanoProxy) string {
+	t.Helper()
+
+	server := httptest.NewServer(np.createRoutes())
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Sends an upgrade request to the proxy, returning the response and the connection to carry on using
+func upgradeRequest(t *testing.T, addr string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, _ = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.net\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read upgrade response: %v", err)
+	}
+
+	return response, conn, reader
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := map[string]bool{
+		"Upgrade":             true,
+		"keep-alive, upgrade": true,
+		"keep-alive":          false,
+		"":                    false,
+	}
+
+	for connection, expected := range tests {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Connection", connection)
+
+		if isUpgrade(request) != expected {
+			t.Errorf("Connection '%s': expected upgrade %v", connection, expected)
+		}
+	}
+}
+
+func TestUpgradeProxied(t *testing.T) {
+	np := newSingleUpstreamProxy(t, config.Upstream{Name: "upgrade-echo", Targets: []config.Target{newUpgradeBackend(t)}},
+		config.Rule{Path: "/ws", Upgrade: &config.Upgrade{}, Timeout: 50 * time.Millisecond})
+	addr := serveProxy(t, np)
+
+	// Metrics are global, so count from where other tests (or runs) left them
+	closed := metricUpgrades.WithLabelValues("upgrade-echo", upgradeClosed)
+	closedBefore := testutil.ToFloat64(closed)
+	active := metricUpgradesActive.WithLabelValues("upgrade-echo")
+	activeBefore := testutil.ToFloat64(active)
+	sent := metricUpgradeBytes.WithLabelValues("upgrade-echo", "to_upstream")
+	sentBefore := testutil.ToFloat64(sent)
+
+	response, conn, reader := upgradeRequest(t, addr)
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", response.StatusCode)
+	}
+
+	// Outlives the rule timeout, which doesn't apply to upgraded connections
+	time.Sleep(100 * time.Millisecond)
+
+	_, _ = conn.Write([]byte("hello\n"))
+
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("Expected line echoed back, got '%s' %v", line, err)
+	}
+
+	if upgraded := np.current().upstreams["upgrade-echo"].status().Upgraded; upgraded != 1 {
+		t.Errorf("Expected 1 upgraded connection, got %d", upgraded)
+	}
+
+	_ = conn.Close()
+
+	waitFor(t, "connection to close", func() bool {
+		return testutil.ToFloat64(closed) == closedBefore+1
+	})
+
+	if count := testutil.ToFloat64(active); count != activeBefore {
+		t.Errorf("Expected no active upgraded connections, got %v", count-activeBefore)
+	}
+
+	if count := testutil.ToFloat64(sent); count != sentBefore+6 {
+		t.Errorf("Expected 6 bytes sent to the upstream, got %v", count-sentBefore)
+	}
+}
+
+func TestUpgradeRuleTimeout(t *testing.T) {
+	addr := serveProxy(t, newSingleUpstreamProxy(t,
+		config.Upstream{Name: "upgrade-default", Targets: []config.Target{newUpgradeBackend(t)}},
+		config.Rule{Path: "/ws", Timeout: 200 * time.Millisecond}))
+
+	response, conn, reader := upgradeRequest(t, addr)
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 for rule without upgrade settings, got %d", response.StatusCode)
+	}
+
+	_, _ = conn.Write([]byte("hello\n"))
+
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("Expected line echoed back, got '%s' %v", line, err)
+	}
+
+	// Not opted into long-lived upgrades, so the rule timeout closes the connection
+	start := time.Now()
+	if _, err := reader.ReadString('\n'); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected connection closed by the rule timeout")
+	}
+}
+
+func TestUpgradeLimit(t *testing.T) {
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:             "upgrade-limit",
+		Targets:          []config.Target{newUpgradeBackend(t)},
+		MaxUpgradedConns: 1,
+	}, config.Rule{Path: "/ws", Upgrade: &config.Upgrade{}})
+	addr := serveProxy(t, np)
+
+	rejected := metricUpgradesRejected.WithLabelValues("upgrade-limit")
+	rejectedBefore := testutil.ToFloat64(rejected)
+
+	if response, _, _ := upgradeRequest(t, addr); response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected first upgrade to be allowed, got %d", response.StatusCode)
+	}
+
+	if response, _, _ := upgradeRequest(t, addr); response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when at the limit, got %d", response.StatusCode)
+	}
+
+	if count := testutil.ToFloat64(rejected); count != rejectedBefore+1 {
+		t.Errorf("Expected 1 rejected upgrade, got %v", count-rejectedBefore)
+	}
+
+	if upgraded := np.current().upstreams["upgrade-limit"].status().Upgraded; upgraded != 1 {
+		t.Errorf("Expected rejected upgrade not to be counted, got %d", upgraded)
+	}
+}
+
+func TestUpgradeLimitKeptAcrossReload(t *testing.T) {
+	np := newSingleUpstreamProxy(t, config.Upstream{
+		Name:             "upgrade-reload",
+		Targets:          []config.Target{newUpgradeBackend(t)},
+		MaxUpgradedConns: 1,
+	}, config.Rule{Path: "/ws", Upgrade: &config.Upgrade{}})
+	addr := serveProxy(t, np)
+
+	if response, _, _ := upgradeRequest(t, addr); response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected first upgrade to be allowed, got %d", response.StatusCode)
+	}
+
+	// The connection opened before the reload still counts towards the limit
+	mustApplyConfig(t, np, np.current().config)
+
+	if response, _, _ := upgradeRequest(t, addr); response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when at the limit after reload, got %d", response.StatusCode)
+	}
+
+	if upgraded := np.current().upstreams["upgrade-reload"].status().Upgraded; upgraded != 1 {
+		t.Errorf("Expected 1 upgraded connection after reload, got %d", upgraded)
+	}
+}
+
+func TestUpgradeTimeouts(t *testing.T) {
+	tests := map[string]config.Upgrade{
+		upgradeIdleTimeout: {IdleTimeout: 100 * time.Millisecond},
+		upgradeMaxDuration: {IdleTimeout: time.Minute, MaxDuration: 200 * time.Millisecond},
+	}
+
+	for reason, conf := range tests {
+		name := "upgrade-" + reason
+		addr := serveProxy(t, newSingleUpstreamProxy(t,
+			config.Upstream{Name: name, Targets: []config.Target{newUpgradeBackend(t)}},
+			config.Rule{Path: "/ws", Upgrade: &conf}))
+
+		closed := metricUpgrades.WithLabelValues(name, reason)
+		closedBefore := testutil.ToFloat64(closed)
+
+		response, conn, reader := upgradeRequest(t, addr)
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: expected 101, got %d", reason, response.StatusCode)
+		}
+
+		// Busy for longer than the idle timeout, so it is only closed once it goes quiet or by the max duration
+		for range 3 {
+			time.Sleep(40 * time.Millisecond)
+
+			_, _ = conn.Write([]byte("ping\n"))
+			_, _ = reader.ReadString('\n')
+		}
+
+		start := time.Now()
+		if _, err := reader.ReadString('\n'); err == nil || time.Since(start) > time.Second {
+			t.Errorf("%s: expected connection closed by the proxy", reason)
+		}
+
+		waitFor(t, reason+" metric", func() bool {
+			return testutil.ToFloat64(closed) == closedBefore+1
+		})
+	}
+}
@@ -0,0 +1,331 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2023. Licensed under the MIT License.
+// NanoProxy upstreams, groups of backend targets behind a reverse proxy
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/benc-uk/nanoproxy/pkg/config"
+)
+
+// An upstream is a named group of targets, each request is sent to one target picked by the balancer
+type upstream struct {
+	name        string
+	targets     []*target
+	strategy    string
+	balancer    balancer
+	proxy       *httputil.ReverseProxy
+	healthCheck *config.HealthCheck      // With defaults filled in, nil when disabled
+	outlier     *config.OutlierDetection // With defaults filled in, nil when disabled
+	retries     *config.RetryPolicy      // With defaults filled in, nil when disabled
+	breaker     *breaker                 // Nil when disabled, shared with other snapshots while unchanged
+	timeouts    config.Timeouts          // With defaults filled in
+	maxUpgrades int                      // Limit on upgraded connections, zero for no limit
+	upgrades    *atomic.Int64            // Upgrade requests admitted & connections open, kept across reloads
+}
+
+// A target is a single backend server instance within an upstream
+type target struct {
+	url           *url.URL
+	weight        int
+	upstream      *upstream       // The upstream this target belongs to
+	transport     *http.Transport // Shared with targets in other snapshots with the same URL & settings
+	active        atomic.Int64    // Requests currently in flight
+	*targetHealth                 // Shared with other snapshots while the target & its checks are unchanged
+}
+
+// Health of a target, kept across config reloads so a sick target isn't put straight back in rotation
+type targetHealth struct {
+	healthy      atomic.Bool  // Set by active health checks, targets start healthy
+	ejectedUntil atomic.Int64 // Set by outlier detection, time in unix nanoseconds
+	outlier      outlierState
+}
+
+// Status of an upstream and its targets, as reported by the admin endpoint
+type upstreamStatus struct {
+	Name           string         `json:"name"`
+	Balancer       string         `json:"balancer"`
+	Targets        []targetStatus `json:"targets"`
+	CircuitBreaker *breakerStatus `json:"circuitBreaker,omitempty"`
+	Upgraded       int64          `json:"upgraded"`
+}
+
+type targetStatus struct {
+	URL     string `json:"url"`
+	Weight  int    `json:"weight"`
+	Active  int64  `json:"active"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+}
+
+// Details of a request being sent to an upstream, filled in as it is proxied
+type proxyInfo struct {
+	target  *target
+	sent    time.Time
+	latency time.Duration // Time until the upstream responded with headers, or failed
+	status  int           // Status code from the upstream
+	err     error         // Set when the upstream could not be reached or failed to respond
+	attempt int           // Which try this was, more than one when the request was retried
+	retry   *retryState   // Nil when the upstream has no retry policy
+	timer   *time.Timer   // Response header or per-try timeout, stopped when the response headers arrive
+	// Error the request is cancelled with when the timer fires
+	timeoutErr error
+}
+
+// Context key used to pass the proxyInfo through to the reverse proxy
+type proxyInfoKey struct{}
+
+// Returns the upstream config with all the defaults filled in
+// A single host becomes one target, and every target gets a port & weight
+func upstreamDefaults(u config.Upstream) config.Upstream {
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+
+	if u.Port == 0 && u.Scheme == "http" {
+		u.Port = 80
+	}
+
+	if u.Port == 0 && u.Scheme == "https" {
+		u.Port = 443
+	}
+
+	if u.Balancer == "" {
+		u.Balancer = balanceRoundRobin
+	}
+
+	// A single host is simply treated as an upstream with one target
+	targets := u.Targets
+	if len(targets) == 0 {
+		targets = []config.Target{{Host: u.Host}}
+	}
+
+	u.Targets = make([]config.Target, 0, len(targets))
+
+	for _, t := range targets {
+		if t.Port == 0 {
+			t.Port = u.Port
+		}
+
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+
+		u.Targets = append(u.Targets, t)
+	}
+
+	if u.HealthCheck != nil {
+		hc := healthCheckDefaults(*u.HealthCheck)
+		u.HealthCheck = &hc
+	}
+
+	if u.OutlierDetection != nil {
+		od := outlierDefaults(*u.OutlierDetection)
+		u.OutlierDetection = &od
+	}
+
+	if u.Retries != nil {
+		rp := retryDefaults(*u.Retries)
+		u.Retries = &rp
+	}
+
+	if u.CircuitBreaker != nil {
+		cb := breakerDefaults(*u.CircuitBreaker)
+		u.CircuitBreaker = &cb
+	}
+
+	return u
+}
+
+// Builds an upstream and its targets from the config
+func newUpstream(u config.Upstream, timeout time.Duration, shared *sharedState) (*upstream, error) {
+	u = upstreamDefaults(u)
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme found: %s", u.Scheme)
+	}
+
+	bal, err := newBalancer(u.Balancer)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := timeoutDefaults(u.Timeouts, timeout)
+	settings := newTransportSettings(u, timeouts)
+
+	revProxy, err := NewReverseProxy(!u.NoHostRewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upstream{
+		name:        u.Name,
+		strategy:    u.Balancer,
+		balancer:    bal,
+		proxy:       revProxy,
+		healthCheck: u.HealthCheck,
+		outlier:     u.OutlierDetection,
+		retries:     u.Retries,
+		breaker:     shared.breakers.get(u.Name, u.CircuitBreaker),
+		timeouts:    timeouts,
+		maxUpgrades: u.MaxUpgradedConns,
+		upgrades:    shared.upgrades.get(u.Name),
+	}
+
+	for _, tc := range u.Targets {
+		targetURL, err := url.Parse(u.Scheme + "://" + tc.Host + ":" + strconv.Itoa(tc.Port))
+		if err != nil {
+			return nil, err
+		}
+
+		t := &target{
+			url:          targetURL,
+			weight:       tc.Weight,
+			upstream:     up,
+			transport:    shared.transports.get(targetURL, settings),
+			targetHealth: shared.health.get(u, targetURL),
+		}
+
+		up.targets = append(up.targets, t)
+	}
+
+	return up, nil
+}
+
+// Returns the targets which are currently able to take requests
+func (u *upstream) available() []*target {
+	targets := make([]*target, 0, len(u.targets))
+	now := time.Now()
+
+	for _, t := range u.targets {
+		if t.healthy.Load() && !t.ejected(now) {
+			targets = append(targets, t)
+		}
+	}
+
+	return targets
+}
+
+// Picks a target for a request, will return nil if there are no available targets
+func (u *upstream) pick() *target {
+	return u.balancer.pick(u.available())
+}
+
+// Returns the target the next request would be sent to, without picking it
+func (u *upstream) peek() *target {
+	return u.balancer.peek(u.available())
+}
+
+// Snapshot of the current state of the upstream
+func (u *upstream) status() upstreamStatus {
+	status := upstreamStatus{
+		Name:           u.name,
+		Balancer:       u.strategy,
+		CircuitBreaker: u.breaker.status(),
+		Upgraded:       u.upgrades.Load(),
+	}
+
+	now := time.Now()
+
+	for _, t := range u.targets {
+		status.Targets = append(status.Targets, targetStatus{
+			URL:     t.url.String(),
+			Weight:  t.weight,
+			Active:  t.active.Load(),
+			Healthy: t.healthy.Load(),
+			Ejected: t.ejected(now),
+		})
+	}
+
+	return status
+}
+
+// Proxies the request to the given target, returning details of how it went
+// When the upstream has a retry policy failed tries are retried, on another target if there is one
+func (u *upstream) serve(w http.ResponseWriter, r *http.Request, t *target, budget *retryBudget) *proxyInfo {
+	budget.request()
+
+	rs := u.newRetryState(r, budget)
+
+	for {
+		info := u.try(w, r, t, rs)
+		if rs == nil || rs.next == nil {
+			return info
+		}
+
+		t = rs.next
+		rs.wait()
+	}
+}
+
+// Proxies the request to the target once, rs is nil when the upstream has no retry policy
+func (u *upstream) try(w http.ResponseWriter, r *http.Request, t *target, rs *retryState) *proxyInfo {
+	t.active.Add(1)
+	defer t.active.Add(-1)
+
+	info := &proxyInfo{target: t, sent: time.Now(), attempt: 1, retry: rs}
+
+	r, span := startClientSpan(r, t)
+	defer endClientSpan(span, info)
+
+	ctx := context.WithValue(r.Context(), proxyInfoKey{}, info)
+
+	// How long to wait for the response headers, a per-try timeout takes over from the upstream's timeout
+	// When the rule has a timeout the request already has a deadline, and that's used instead
+	wait, timeoutErr := u.timeouts.ResponseHeader, errHeaderTimeout
+	if _, ok := ctx.Deadline(); ok {
+		wait = 0
+	}
+
+	if rs != nil && rs.policy.PerTryTimeout > 0 {
+		wait, timeoutErr = rs.policy.PerTryTimeout, errPerTryTimeout
+	}
+
+	if wait > 0 {
+		var cancel context.CancelCauseFunc
+
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		info.timeoutErr = timeoutErr
+		info.timer = time.AfterFunc(wait, func() { cancel(timeoutErr) })
+
+		defer info.timer.Stop()
+	}
+
+	r = r.WithContext(ctx)
+
+	if rs != nil {
+		rs.begin(r, t)
+		info.attempt = rs.attempt
+	}
+
+	u.proxy.ServeHTTP(w, r)
+
+	return info
+}
+
+// Fetch the details of the request being proxied, if any
+func proxyInfoFromContext(ctx context.Context) *proxyInfo {
+	info, _ := ctx.Value(proxyInfoKey{}).(*proxyInfo)
+	return info
+}
+
+// Fetch the target picked for this request, if any
+func targetFromContext(ctx context.Context) *target {
+	if info := proxyInfoFromContext(ctx); info != nil {
+		return info.target
+	}
+
+	return nil
+}